@@ -0,0 +1,173 @@
+package gsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log outcomes
+const (
+	OutcomeOK            = "ok"
+	OutcomeTimeout       = "timeout"
+	OutcomeTunnelClosed  = "tunnel_closed"
+	OutcomeRetried       = "retried"
+	OutcomeForwardFailed = "forward_failed"
+	OutcomeOverloaded    = "overloaded"
+)
+
+// AccessRecord access log record of one proxied request
+type AccessRecord struct {
+	Time         time.Time `json:"time"`          // forward time
+	Device       string    `json:"device"`        // device name
+	Service      uint16    `json:"service"`       // service id
+	Method       uint16    `json:"method"`        // method id
+	Tunnel       uint32    `json:"tunnel"`        // target tunnel id
+	RequestSize  int       `json:"request_size"`  // request content bytes
+	ResponseSize int       `json:"response_size"` // response content bytes, 0 if no response
+	Latency      float64   `json:"latency_ms"`    // latency in milliseconds
+	Outcome      string    `json:"outcome"`       // outcome
+}
+
+// AccessSink access log sink
+type AccessSink interface {
+	// Log write one access record
+	Log(record *AccessRecord) error
+}
+
+type _JSONSink struct {
+	sync.Mutex               // mutex
+	encoder    *json.Encoder // json lines encoder
+}
+
+// NewJSONSink create access sink writes one json object per line
+func NewJSONSink(writer io.Writer) AccessSink {
+	return &_JSONSink{
+		encoder: json.NewEncoder(writer),
+	}
+}
+
+func (sink *_JSONSink) Log(record *AccessRecord) error {
+	sink.Lock()
+	defer sink.Unlock()
+
+	return sink.encoder.Encode(record)
+}
+
+// RotateFile file writer rotates to path.1 ... path.N when file size exceeds max size
+type RotateFile struct {
+	sync.Mutex          // mutex
+	path       string   // file path
+	maxSize    int64    // max file size in bytes
+	backups    int      // max rotated files
+	file       *os.File // current file
+	size       int64    // current file size
+}
+
+// NewRotateFile open rotate file for appending
+func NewRotateFile(path string, maxSize int64, backups int) (*RotateFile, error) {
+
+	rotate := &RotateFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	if err := rotate.open(); err != nil {
+		return nil, err
+	}
+
+	return rotate, nil
+}
+
+func (rotate *RotateFile) open() error {
+
+	file, err := os.OpenFile(rotate.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotate.file = file
+
+	rotate.size = info.Size()
+
+	return nil
+}
+
+// Write implement io.Writer
+func (rotate *RotateFile) Write(p []byte) (int, error) {
+	rotate.Lock()
+	defer rotate.Unlock()
+
+	if rotate.maxSize > 0 && rotate.size > 0 && rotate.size+int64(len(p)) > rotate.maxSize {
+		if err := rotate.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotate.file.Write(p)
+
+	rotate.size += int64(n)
+
+	return n, err
+}
+
+func (rotate *RotateFile) rotate() error {
+
+	rotate.file.Close()
+
+	for i := rotate.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rotate.path, i), fmt.Sprintf("%s.%d", rotate.path, i+1))
+	}
+
+	if rotate.backups > 0 {
+		os.Rename(rotate.path, rotate.path+".1")
+	} else {
+		os.Remove(rotate.path)
+	}
+
+	return rotate.open()
+}
+
+// Close implement io.Closer
+func (rotate *RotateFile) Close() error {
+	rotate.Lock()
+	defer rotate.Unlock()
+
+	return rotate.file.Close()
+}
+
+// access write access record of pending request
+func (proxy *_Proxy) access(pending *_PendingRequest, outcome string, responseSize int) {
+
+	if proxy.accessSink == nil {
+		return
+	}
+
+	record := &AccessRecord{
+		Time:         pending.sent,
+		Device:       pending.handler.device.String(),
+		Service:      pending.service,
+		Method:       pending.method,
+		Tunnel:       pending.tunnel,
+		RequestSize:  len(pending.content),
+		ResponseSize: responseSize,
+		Latency:      float64(time.Since(pending.sent)) / float64(time.Millisecond),
+		Outcome:      outcome,
+	}
+
+	if err := proxy.accessSink.Log(record); err != nil {
+		proxy.E("write access log -- failed\n%s", err)
+	}
+}
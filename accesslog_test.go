@@ -0,0 +1,129 @@
+package gsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gsdocker/gsproxy/trace"
+)
+
+type _MockSink struct {
+	records []*AccessRecord
+}
+
+func (sink *_MockSink) Log(record *AccessRecord) error {
+	sink.records = append(sink.records, record)
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	sink := &_MockSink{}
+
+	proxy.accessSink = sink
+
+	request := newPendingRequest(1, 1)
+
+	request.Method = 2
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), request, trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	context := &_MockContext{pipeline: servers[0]}
+
+	if _, err := servers[0].tunnel.MessageReceived(context, newTunnelResponse(handler.device, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatal("expect one access record")
+	}
+
+	record := sink.records[0]
+
+	if record.Outcome != OutcomeOK || record.Service != 1 || record.Method != 2 || record.Tunnel != 1 {
+		t.Fatalf("unexpect access record %v", record)
+	}
+}
+
+func TestAccessLogTunnelClosed(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	sink := &_MockSink{}
+
+	proxy.accessSink = sink
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[0].tunnel.Inactive(&_MockContext{pipeline: servers[0]})
+
+	if len(sink.records) != 1 || sink.records[0].Outcome != OutcomeTunnelClosed {
+		t.Fatal("expect tunnel_closed access record")
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+
+	var buff bytes.Buffer
+
+	sink := NewJSONSink(&buff)
+
+	sink.Log(&AccessRecord{Device: "test", Outcome: OutcomeOK})
+
+	var record AccessRecord
+
+	if err := json.Unmarshal(buff.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Device != "test" || record.Outcome != OutcomeOK {
+		t.Fatalf("unexpect access record %v", record)
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "gsproxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+
+	file, err := NewRotateFile(path, 8, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := file.Write([]byte("12345678")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatal("expect at most 2 backups")
+	}
+}
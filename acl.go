@@ -0,0 +1,132 @@
+package gsproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPFilter CIDR allow/deny list of listener peers, deny wins over allow and
+// empty allow list allows all peers not denied. Reload replaces both lists at
+// runtime
+type IPFilter struct {
+	sync.RWMutex              // mutex
+	allow        []*net.IPNet // allowed networks
+	deny         []*net.IPNet // denied networks
+}
+
+// NewIPFilter create filter from CIDRs or single ips
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+
+	filter := &IPFilter{}
+
+	if err := filter.Reload(allow, deny); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Reload replace allow and deny lists, the filter is unchanged on error
+func (filter *IPFilter) Reload(allow []string, deny []string) error {
+
+	allowNets, err := parseCIDRs(allow)
+
+	if err != nil {
+		return err
+	}
+
+	denyNets, err := parseCIDRs(deny)
+
+	if err != nil {
+		return err
+	}
+
+	filter.Lock()
+	defer filter.Unlock()
+
+	filter.allow = allowNets
+
+	filter.deny = denyNets
+
+	return nil
+}
+
+// Allowed check if peer ip is allowed
+func (filter *IPFilter) Allowed(ip net.IP) bool {
+
+	if filter == nil {
+		return true
+	}
+
+	filter.RLock()
+	defer filter.RUnlock()
+
+	for _, network := range filter.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(filter.allow) == 0 {
+		return true
+	}
+
+	for _, network := range filter.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+
+		cidr = strings.TrimSpace(cidr)
+
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+
+			ip := net.ParseIP(cidr)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %s", cidr)
+			}
+
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// splitCIDRs split comma separated gsconfig value
+func splitCIDRs(value string) []string {
+
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,42 @@
+package gsproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "192.168.1.1"}, []string{"10.1.0.0/16"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.0.1":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+	} {
+		if filter.Allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("unexpect filter result of %s", ip)
+		}
+	}
+
+	if err := filter.Reload([]string{"invalid"}, nil); err == nil {
+		t.Fatal("expect invalid cidr error")
+	}
+
+	if filter.Allowed(net.ParseIP("192.168.1.2")) {
+		t.Fatal("expect filter unchanged on reload error")
+	}
+
+	if err := filter.Reload(nil, []string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.Allowed(net.ParseIP("10.0.0.1")) || !filter.Allowed(net.ParseIP("192.168.1.2")) {
+		t.Fatal("expect reloaded deny list")
+	}
+}
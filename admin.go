@@ -0,0 +1,225 @@
+package gsproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrAdminToken admin api listens on non-loopback address without token
+var ErrAdminToken = errors.New("gsproxy admin api on non-loopback address requires token")
+
+// AdminClient client entry of admin api
+type AdminClient struct {
+	Device    string            `json:"device"`    // device name
+	Remote    string            `json:"remote"`    // client pipeline name, the remote address
+	Connected time.Time         `json:"connected"` // connect time
+	Bindings  map[uint16]uint32 `json:"bindings"`  // trans-proxy bindings, service id to tunnel id
+}
+
+// AdminService announced service entry of admin api
+type AdminService struct {
+	Name string `json:"name"` // service name
+	ID   uint16 `json:"id"`   // service dispatch id
+}
+
+// AdminTunnel backend tunnel entry of admin api
+type AdminTunnel struct {
+	ID       uint32         `json:"id"`       // tunnel id
+	Remote   string         `json:"remote"`   // tunnel pipeline name, the remote address
+	InFlight int64          `json:"inflight"` // in-flight requests
+	Queued   int            `json:"queued"`   // requests waiting for tunnel capacity
+	Services []AdminService `json:"services"` // announced services
+}
+
+// adminHandler create admin api handler:
+//
+//	GET    /clients            list connected clients
+//	DELETE /clients?device=id  kick device
+//	GET    /tunnels            list backend tunnels
+//	DELETE /tunnels?id=n       detach backend tunnel
+//
+// requests must carry the bearer token if token is not empty
+func (proxy *_Proxy) adminHandler(token string) http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminJSON(w, proxy.adminClients())
+		case http.MethodDelete:
+			if !proxy.kick(r.URL.Query().Get("device")) {
+				http.Error(w, "device not found", http.StatusNotFound)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminJSON(w, proxy.adminTunnels())
+		case http.MethodDelete:
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+
+			if err != nil {
+				http.Error(w, "invalid tunnel id", http.StatusBadRequest)
+				return
+			}
+
+			if !proxy.detach(uint32(id)) {
+				http.Error(w, "tunnel not found", http.StatusNotFound)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	expect := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expect) != 1 {
+			proxy.W("admin request %s %s from %s unauthorized", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// loopback check if listen address only accepts local connections
+func loopback(laddr string) bool {
+
+	host, _, err := net.SplitHostPort(laddr)
+
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminJSON(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(val)
+}
+
+func (proxy *_Proxy) adminClients() []*AdminClient {
+
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	clients := make([]*AdminClient, 0)
+
+	for _, sessions := range proxy.clients {
+		for _, client := range sessions {
+
+			entry := &AdminClient{
+				Device:    client.device.String(),
+				Remote:    client.pipeline.Name(),
+				Connected: client.connected,
+				Bindings:  make(map[uint16]uint32),
+			}
+
+			transproxy := client.transproxy()
+
+			transproxy.RLock()
+
+			for service, server := range transproxy.servers {
+				if tunnel, ok := tunnelOf(server); ok {
+					entry.Bindings[service] = tunnel.ID()
+				}
+			}
+
+			transproxy.RUnlock()
+
+			clients = append(clients, entry)
+		}
+	}
+
+	return clients
+}
+
+func (proxy *_Proxy) adminTunnels() []*AdminTunnel {
+
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	tunnels := make([]*AdminTunnel, 0)
+
+	for id, server := range proxy.servers {
+
+		entry := &AdminTunnel{
+			ID:       id,
+			Remote:   server.Name(),
+			Services: make([]AdminService, 0),
+		}
+
+		if tunnel, ok := tunnelOf(server); ok {
+
+			entry.InFlight = tunnel.InFlight()
+
+			entry.Queued = tunnel.QueueDepth()
+
+			for _, service := range tunnel.services {
+				entry.Services = append(entry.Services, AdminService{Name: service.Name, ID: service.DispatchID})
+			}
+		}
+
+		tunnels = append(tunnels, entry)
+	}
+
+	return tunnels
+}
+
+// kick close all sessions of device
+func (proxy *_Proxy) kick(device string) bool {
+
+	proxy.RLock()
+
+	sessions := proxy.clients[device]
+
+	proxy.RUnlock()
+
+	for _, client := range sessions {
+		proxy.I("admin kick device(%s)", device)
+		client.Close()
+	}
+
+	return len(sessions) > 0
+}
+
+// detach close backend tunnel
+func (proxy *_Proxy) detach(id uint32) bool {
+
+	proxy.RLock()
+
+	server, ok := proxy.servers[id]
+
+	proxy.RUnlock()
+
+	if ok {
+		proxy.I("admin detach tunnel(%d)", id)
+		server.Close()
+	}
+
+	return ok
+}
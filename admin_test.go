@@ -0,0 +1,150 @@
+package gsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func TestAdmin(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.servers = map[uint32]Server{1: servers[0]}
+
+	servers[0].tunnel.services = []*gorpc.NamedService{newNamedService(1)}
+
+	client := newRegistryClient(proxy, "device")
+
+	client.pipeline.(*_MockPipeline).transproxy = handler
+
+	handler.bind(1, servers[0])
+
+	proxy.addClient(client)
+
+	admin := httptest.NewServer(proxy.adminHandler(""))
+
+	defer admin.Close()
+
+	var clients []*AdminClient
+
+	adminGet(t, admin.URL+"/clients", &clients)
+
+	if len(clients) != 1 || clients[0].Bindings[1] != 1 {
+		t.Fatalf("unexpected clients %v", clients)
+	}
+
+	var tunnels []*AdminTunnel
+
+	adminGet(t, admin.URL+"/tunnels", &tunnels)
+
+	if len(tunnels) != 1 || len(tunnels[0].Services) != 1 {
+		t.Fatalf("unexpected tunnels %v", tunnels)
+	}
+
+	adminDelete(t, admin.URL+"/clients?device="+client.device.String())
+
+	if !client.pipeline.(*_MockPipeline).closed {
+		t.Fatal("expect device kicked")
+	}
+
+	adminDelete(t, admin.URL+"/tunnels?id=1")
+
+	if !servers[0].closed {
+		t.Fatal("expect tunnel detached")
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+
+	proxy, _, _ := newPendingProxy()
+
+	admin := httptest.NewServer(proxy.adminHandler("secret"))
+
+	defer admin.Close()
+
+	request, _ := http.NewRequest(http.MethodDelete, admin.URL+"/clients?device=device", nil)
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized, got %d", response.StatusCode)
+	}
+
+	request.Header.Set("Authorization", "Bearer secret")
+
+	response, err = http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expect authorized request reach api, got %d", response.StatusCode)
+	}
+}
+
+func TestAdminLoopback(t *testing.T) {
+
+	for laddr, expect := range map[string]bool{
+		"127.0.0.1:0":   true,
+		"[::1]:8080":    true,
+		"localhost:0":   true,
+		":8080":         false,
+		"0.0.0.0:8080":  false,
+		"10.0.0.1:8080": false,
+	} {
+		if loopback(laddr) != expect {
+			t.Fatalf("loopback(%s) expect %v", laddr, expect)
+		}
+	}
+
+	_, err := BuildProxy(&_MockProxy{}).AddrF(":0").AddrB(":0").AddrA(":0").BuildE("gsproxy-admin")
+
+	if err != ErrAdminToken {
+		t.Fatalf("expect ErrAdminToken, got %v", err)
+	}
+}
+
+func adminGet(t *testing.T, url string, val interface{}) {
+
+	response, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(val); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func adminDelete(t *testing.T, url string) {
+
+	request, _ := http.NewRequest(http.MethodDelete, url, nil)
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE %s status %d", url, response.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package gsproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// _Admission frontend connection limits checked before the dh handshake,
+// nil admission accepts all connections
+type _Admission struct {
+	sync.Mutex                // mutex
+	maxConns   int            // max concurrent connections, zero unlimited
+	maxPerIP   int            // max concurrent connections per source ip, zero unlimited
+	handshakes *_TokenBucket  // new connection rate, nil unlimited
+	conns      int            // current connections
+	perIP      map[string]int // current connections per source ip
+}
+
+func newAdmission(maxConns int, maxPerIP int, handshake RateLimit) *_Admission {
+
+	if maxConns <= 0 && maxPerIP <= 0 && !handshake.enabled() {
+		return nil
+	}
+
+	admission := &_Admission{
+		maxConns: maxConns,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+
+	if handshake.enabled() {
+		admission.handshakes = newTokenBucket(handshake)
+	}
+
+	return admission
+}
+
+// admit check connection against the limits, the returned conn releases its
+// slot on close
+func (admission *_Admission) admit(conn net.Conn) (net.Conn, error) {
+
+	if admission == nil {
+		return conn, nil
+	}
+
+	ip := remoteIP(conn)
+
+	admission.Lock()
+	defer admission.Unlock()
+
+	if admission.maxConns > 0 && admission.conns >= admission.maxConns {
+		return nil, ErrMaxConns
+	}
+
+	if admission.maxPerIP > 0 && admission.perIP[ip] >= admission.maxPerIP {
+		return nil, ErrMaxConnsPerIP
+	}
+
+	if admission.handshakes != nil && !admission.handshakes.take(time.Now()) {
+		return nil, ErrHandshakeRate
+	}
+
+	admission.conns++
+
+	admission.perIP[ip]++
+
+	return &_AdmittedConn{Conn: conn, admission: admission, ip: ip}, nil
+}
+
+func (admission *_Admission) release(ip string) {
+	admission.Lock()
+	defer admission.Unlock()
+
+	admission.conns--
+
+	if admission.perIP[ip]--; admission.perIP[ip] <= 0 {
+		delete(admission.perIP, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+type _AdmittedConn struct {
+	net.Conn              // underlying connection
+	admission *_Admission // admission
+	ip        string      // source ip
+	once      sync.Once   // release once
+}
+
+func (conn *_AdmittedConn) Close() error {
+
+	conn.once.Do(func() {
+		conn.admission.release(conn.ip)
+	})
+
+	return conn.Conn.Close()
+}
@@ -0,0 +1,77 @@
+package gsproxy
+
+import (
+	"net"
+	"testing"
+)
+
+type _MockConn struct {
+	net.Conn
+	addr   net.Addr
+	closed bool
+}
+
+func (conn *_MockConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *_MockConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func newMockConn(ip string) *_MockConn {
+	return &_MockConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 10000}}
+}
+
+func TestAdmission(t *testing.T) {
+
+	admission := newAdmission(2, 1, RateLimit{})
+
+	first, err := admission.admit(newMockConn("10.0.0.1"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admission.admit(newMockConn("10.0.0.1")); err != ErrMaxConnsPerIP {
+		t.Fatal("expect per ip cap")
+	}
+
+	if _, err := admission.admit(newMockConn("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admission.admit(newMockConn("10.0.0.3")); err != ErrMaxConns {
+		t.Fatal("expect max connections")
+	}
+
+	first.Close()
+
+	first.Close()
+
+	if _, err := admission.admit(newMockConn("10.0.0.3")); err != nil {
+		t.Fatal("expect closed connection released once")
+	}
+
+	if _, err := admission.admit(newMockConn("10.0.0.4")); err != ErrMaxConns {
+		t.Fatal("expect max connections")
+	}
+}
+
+func TestAdmissionHandshakeRate(t *testing.T) {
+
+	admission := newAdmission(0, 0, RateLimit{Rate: 1, Burst: 1})
+
+	if _, err := admission.admit(newMockConn("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admission.admit(newMockConn("10.0.0.2")); err != ErrHandshakeRate {
+		t.Fatal("expect handshake rate exceeded")
+	}
+
+	if newAdmission(0, 0, RateLimit{}) != nil {
+		t.Fatal("expect nil admission without limits")
+	}
+}
@@ -0,0 +1,108 @@
+package gsproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+// AffinityListener optional Proxy extension, notified when a sticky device is
+// moved to a new backend because its backend tunnel went away
+type AffinityListener interface {
+	// Failover report device's service moved from the closed server to a new one
+	Failover(context Context, device *gorpc.Device, service uint16, from Server, to Server)
+}
+
+type _AffinityEntry struct {
+	server Server    // assigned backend server
+	expire time.Time // expire time
+}
+
+type _FailoverF func(device *gorpc.Device, service uint16, from Server, to Server)
+
+// _Affinity the device to backend assignments of stateful services
+type _Affinity struct {
+	sync.Mutex                            // mutex
+	ttl        time.Duration              // idle assignment ttl
+	entries    map[string]*_AffinityEntry // assignments indexed by device and service
+	swept      time.Time                  // last sweep time
+	failover   _FailoverF                 // failover notifier
+}
+
+func newAffinity(ttl time.Duration) *_Affinity {
+	return &_Affinity{
+		ttl:     ttl,
+		entries: make(map[string]*_AffinityEntry),
+		swept:   time.Now(),
+	}
+}
+
+// route get the assigned server of device, assign a new one by selector when
+// the assignment is missing, expired or its server went away
+func (affinity *_Affinity) route(
+	service uint16,
+	device *gorpc.Device,
+	servers []Server,
+	selector func(service uint16, device *gorpc.Device, servers []Server) (Server, bool)) (Server, bool) {
+
+	key := fmt.Sprintf("%s:%d", device, service)
+
+	now := time.Now()
+
+	affinity.Lock()
+
+	affinity.sweep(now)
+
+	var from Server
+
+	if entry, ok := affinity.entries[key]; ok && now.Before(entry.expire) {
+
+		for _, server := range servers {
+			if server == entry.server {
+				entry.expire = now.Add(affinity.ttl)
+				affinity.Unlock()
+				return server, true
+			}
+		}
+
+		from = entry.server
+	}
+
+	server, ok := selector(service, device, servers)
+
+	if !ok {
+		affinity.Unlock()
+		return nil, false
+	}
+
+	affinity.entries[key] = &_AffinityEntry{
+		server: server,
+		expire: now.Add(affinity.ttl),
+	}
+
+	affinity.Unlock()
+
+	if from != nil && affinity.failover != nil {
+		affinity.failover(device, service, from, server)
+	}
+
+	return server, true
+}
+
+// sweep remove expired assignments at most once per ttl
+func (affinity *_Affinity) sweep(now time.Time) {
+
+	if now.Sub(affinity.swept) < affinity.ttl {
+		return
+	}
+
+	affinity.swept = now
+
+	for key, entry := range affinity.entries {
+		if !now.Before(entry.expire) {
+			delete(affinity.entries, key)
+		}
+	}
+}
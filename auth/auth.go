@@ -0,0 +1,166 @@
+// Package auth backend agent authentication on the gsproxy tunnel handshake
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MessageFlag gorpc message agent value marks the TunnelWhoAmI content is
+// prefixed with credential
+const MessageFlag byte = 0xfe
+
+// Errors .
+var (
+	ErrCredential = errors.New("invalid tunnel credential")
+	ErrExpired    = errors.New("tunnel credential expired")
+	ErrRequired   = errors.New("tunnel credential required")
+	ErrReplayed   = errors.New("tunnel credential replayed")
+)
+
+// Signer create credential of TunnelWhoAmI content on the agent side
+type Signer interface {
+	Sign(content []byte) ([]byte, error)
+}
+
+// Verifier verify credential of TunnelWhoAmI content on the proxy side
+type Verifier interface {
+	Verify(credential []byte, content []byte) error
+}
+
+// VerifierF function as Verifier
+type VerifierF func(credential []byte, content []byte) error
+
+// Verify implement Verifier
+func (f VerifierF) Verify(credential []byte, content []byte) error {
+	return f(credential, content)
+}
+
+// Encode prefix message content with credential, credential longer than 255
+// bytes is not supported
+func Encode(credential []byte, content []byte) ([]byte, error) {
+
+	if len(credential) > 0xff {
+		return nil, ErrCredential
+	}
+
+	buff := make([]byte, 0, 1+len(credential)+len(content))
+
+	buff = append(buff, byte(len(credential)))
+
+	buff = append(buff, credential...)
+
+	return append(buff, content...), nil
+}
+
+// Decode split credential prefixed message content
+func Decode(content []byte) ([]byte, []byte, error) {
+
+	if len(content) == 0 || len(content) < 1+int(content[0]) {
+		return nil, nil, ErrCredential
+	}
+
+	length := 1 + int(content[0])
+
+	return content[1:length], content[length:], nil
+}
+
+// header length of HMAC credential, the sign time followed by random nonce
+const header = 16
+
+// HMAC shared secret signer and verifier, the credential is the sign time and
+// a random nonce followed by HMAC-SHA256 of them and content. the verifier
+// rejects credentials seen within the window, a zero window disables both
+// the age and the replay check and is meant for signers only
+type HMAC struct {
+	sync.Mutex                      // mutex
+	secret     []byte               // shared secret
+	window     time.Duration        // max clock skew and credential age
+	seen       map[string]time.Time // verified credentials indexed by mac
+}
+
+// NewHMAC create shared secret signer and verifier
+func NewHMAC(secret []byte, window time.Duration) *HMAC {
+	return &HMAC{
+		secret: secret,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (signer *HMAC) sum(header []byte, content []byte) []byte {
+
+	mac := hmac.New(sha256.New, signer.secret)
+
+	mac.Write(header)
+
+	mac.Write(content)
+
+	return mac.Sum(nil)
+}
+
+// Sign implement Signer
+func (signer *HMAC) Sign(content []byte) ([]byte, error) {
+
+	credential := make([]byte, header)
+
+	binary.BigEndian.PutUint64(credential, uint64(time.Now().Unix()))
+
+	if _, err := rand.Read(credential[8:]); err != nil {
+		return nil, err
+	}
+
+	return append(credential, signer.sum(credential, content)...), nil
+}
+
+// Verify implement Verifier
+func (signer *HMAC) Verify(credential []byte, content []byte) error {
+
+	if len(credential) != header+sha256.Size {
+		return ErrCredential
+	}
+
+	if !hmac.Equal(credential[header:], signer.sum(credential[:header], content)) {
+		return ErrCredential
+	}
+
+	if signer.window <= 0 {
+		return nil
+	}
+
+	signed := time.Unix(int64(binary.BigEndian.Uint64(credential[:8])), 0)
+
+	now := time.Now()
+
+	if skew := now.Sub(signed); skew > signer.window || skew < -signer.window {
+		return ErrExpired
+	}
+
+	return signer.remember(string(credential[header:]), signed, now)
+}
+
+// remember record verified credential until it expires, returns ErrReplayed
+// if the credential was already seen
+func (signer *HMAC) remember(mac string, signed time.Time, now time.Time) error {
+	signer.Lock()
+	defer signer.Unlock()
+
+	for key, seen := range signer.seen {
+		if now.Sub(seen) > signer.window {
+			delete(signer.seen, key)
+		}
+	}
+
+	if _, ok := signer.seen[mac]; ok {
+		return ErrReplayed
+	}
+
+	signer.seen[mac] = signed
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHMAC(t *testing.T) {
+
+	signer := NewHMAC([]byte("secret"), time.Minute)
+
+	credential, err := signer.Sign([]byte("whoami"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := Encode(credential, []byte("whoami"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, whoAmI, err := Decode(content)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer.Verify(decoded, whoAmI); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer.Verify(decoded, []byte("forged")); err != ErrCredential {
+		t.Fatal("expect forged content rejected")
+	}
+
+	if err := NewHMAC([]byte("other"), time.Minute).Verify(decoded, whoAmI); err != ErrCredential {
+		t.Fatal("expect wrong secret rejected")
+	}
+}
+
+func TestHMACExpired(t *testing.T) {
+
+	signer := NewHMAC([]byte("secret"), time.Minute)
+
+	credential, _ := signer.Sign([]byte("whoami"))
+
+	credential[7] -= 120
+
+	credential = append(credential[:header], signer.sum(credential[:header], []byte("whoami"))...)
+
+	if err := signer.Verify(credential, []byte("whoami")); err != ErrExpired {
+		t.Fatal("expect expired credential rejected")
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+
+	signer := NewHMAC([]byte("secret"), time.Minute)
+
+	first, _ := signer.Sign([]byte("whoami"))
+
+	second, _ := signer.Sign([]byte("whoami"))
+
+	if err := signer.Verify(first, []byte("whoami")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer.Verify(first, []byte("whoami")); err != ErrReplayed {
+		t.Fatal("expect replayed credential rejected")
+	}
+
+	if err := signer.Verify(second, []byte("whoami")); err != nil {
+		t.Fatal("expect credential signed again accepted")
+	}
+}
+
+func TestDecode(t *testing.T) {
+
+	if _, _, err := Decode([]byte{10, 1, 2}); err != ErrCredential {
+		t.Fatal("expect truncated credential rejected")
+	}
+}
@@ -0,0 +1,166 @@
+package gsproxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gsdocker/gslogger"
+	"github.com/gsrpc/gorpc"
+	"github.com/gsrpc/gorpc/handler"
+)
+
+var authHandler = "gsproxy-auth"
+
+// ErrAuthMessage returned by Authenticator to wait for the first client message
+var ErrAuthMessage = errors.New("gsproxy wait auth message")
+
+// Claims attributes attached to authenticated client
+type Claims map[string]string
+
+// AuthError reject device with reason code, the client receives a CodeReject
+// message whose content is the reason code byte
+type AuthError struct {
+	Code   byte   // reason code
+	Reason string // reason description, only logged
+}
+
+// NewAuthError create reject error
+func NewAuthError(code byte, reason string) *AuthError {
+	return &AuthError{Code: code, Reason: reason}
+}
+
+func (err *AuthError) Error() string {
+	return fmt.Sprintf("gsproxy auth rejected(%d) :%s", err.Code, err.Reason)
+}
+
+// Authenticator authenticate device after the crypto handshake and before the
+// client is reported to Proxy.AddClient. It is called with nil message first,
+// returning ErrAuthMessage makes the proxy call it again with the first client
+// message. Return *AuthError to reject with reason code
+type Authenticator interface {
+	Authenticate(device *gorpc.Device, message *gorpc.Message) (Claims, error)
+}
+
+// AuthenticatorF function as Authenticator
+type AuthenticatorF func(device *gorpc.Device, message *gorpc.Message) (Claims, error)
+
+// Authenticate implement Authenticator
+func (f AuthenticatorF) Authenticate(device *gorpc.Device, message *gorpc.Message) (Claims, error) {
+	return f(device, message)
+}
+
+type _AuthHandler struct {
+	gslogger.Log                // mixin log APIs
+	proxy         *_Proxy       // proxy
+	authenticator Authenticator // authenticator, nil admits all devices
+	device        *gorpc.Device // handshaked device
+	waiting       bool          // waiting for auth message
+	claims        Claims        // claims of authenticated device
+}
+
+func (proxy *_Proxy) newAuthHandler() gorpc.Handler {
+	return &_AuthHandler{
+		Log:           gslogger.Get("gsproxy-auth"),
+		proxy:         proxy,
+		authenticator: proxy.authenticator,
+	}
+}
+
+func (auth *_AuthHandler) Register(context gorpc.Context) error {
+	return nil
+}
+
+func (auth *_AuthHandler) Active(context gorpc.Context) error {
+
+	if auth.authenticator == nil {
+		return nil
+	}
+
+	dh, _ := context.Pipeline().Handler(dhHandler)
+
+	auth.device = dh.(handler.CryptoServer).GetDevice()
+
+	return auth.authenticate(context, nil)
+}
+
+// authenticate run authenticator, returns gorpc.ErrSkip to hold the pipeline
+// activation until the auth message arrived
+func (auth *_AuthHandler) authenticate(context gorpc.Context, message *gorpc.Message) error {
+
+	claims, err := auth.authenticator.Authenticate(auth.device, message)
+
+	if err == ErrAuthMessage {
+		auth.waiting = true
+		return gorpc.ErrSkip
+	}
+
+	if err != nil {
+		auth.reject(context, err)
+		return err
+	}
+
+	auth.waiting = false
+
+	auth.claims = claims
+
+	auth.D("[%s] device(%s) authenticated", context.Name(), auth.device)
+
+	return nil
+}
+
+func (auth *_AuthHandler) reject(context gorpc.Context, err error) {
+
+	auth.W("[%s] device(%s) rejected\n%s", context.Name(), auth.device, err)
+
+	var code byte
+
+	if authErr, ok := err.(*AuthError); ok {
+		code = authErr.Code
+	}
+
+	auth.proxy.metrics.authRejected(code)
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeReject
+
+	message.Content = []byte{code}
+
+	context.Send(message)
+
+	context.Close()
+}
+
+func (auth *_AuthHandler) Unregister(context gorpc.Context) {
+}
+
+func (auth *_AuthHandler) Inactive(context gorpc.Context) {
+}
+
+func (auth *_AuthHandler) MessageReceived(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+
+	if !auth.waiting {
+		return message, nil
+	}
+
+	err := auth.authenticate(context, message)
+
+	if err == gorpc.ErrSkip {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	context.FireActive()
+
+	return nil, nil
+}
+
+func (auth *_AuthHandler) MessageSending(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+	return message, nil
+}
+
+func (auth *_AuthHandler) Panic(context gorpc.Context, err error) {
+}
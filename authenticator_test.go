@@ -0,0 +1,99 @@
+package gsproxy
+
+import (
+	"testing"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func newAuthContext(id string) *_MockHandshakeContext {
+
+	device := gorpc.NewDevice()
+
+	device.ID = id
+
+	context := &_MockHandshakeContext{}
+
+	context.pipeline = &_MockPipeline{dh: &_TLSServer{device: device}}
+
+	return context
+}
+
+func TestAuthenticator(t *testing.T) {
+
+	proxy := newRegistryProxy(&_MockProxy{})
+
+	proxy.metrics = proxy.newMetrics()
+
+	proxy.authenticator = AuthenticatorF(func(device *gorpc.Device, message *gorpc.Message) (Claims, error) {
+
+		if device.ID == "banned" {
+			return nil, NewAuthError(3, "banned device")
+		}
+
+		if message == nil {
+			return nil, ErrAuthMessage
+		}
+
+		return Claims{"token": string(message.Content)}, nil
+	})
+
+	auth := proxy.newAuthHandler().(*_AuthHandler)
+
+	context := newAuthContext("device")
+
+	if err := auth.Active(context); err != gorpc.ErrSkip {
+		t.Fatal("expect activation held for auth message")
+	}
+
+	message := gorpc.NewMessage()
+
+	message.Content = []byte("secret")
+
+	if forward, err := auth.MessageReceived(context, message); forward != nil || err != nil {
+		t.Fatal("expect auth message consumed")
+	}
+
+	if !context.active || auth.claims["token"] != "secret" {
+		t.Fatal("expect device authenticated with claims")
+	}
+
+	if forward, _ := auth.MessageReceived(context, newPendingMessage()); forward == nil {
+		t.Fatal("expect messages passed after authenticated")
+	}
+
+	banned := proxy.newAuthHandler().(*_AuthHandler)
+
+	context = newAuthContext("banned")
+
+	if err := banned.Active(context); err == nil || !context.closed {
+		t.Fatal("expect banned device rejected")
+	}
+
+	if len(context.sent) != 1 || context.sent[0].Code != gorpc.CodeReject || context.sent[0].Content[0] != 3 {
+		t.Fatal("expect reject message with reason code")
+	}
+
+	if proxy.metrics.authRejects.Get("3") != 1 {
+		t.Fatal("expect one rejected device")
+	}
+}
+
+func TestAuthenticatorClaims(t *testing.T) {
+
+	proxy := newRegistryProxy(&_MockRegistryProxy{})
+
+	context := newAuthContext("device")
+
+	context.pipeline.(*_MockPipeline).auth = &_AuthHandler{claims: Claims{"role": "admin"}}
+
+	client := proxy.newClientHandler().(*_Client)
+
+	if err := client.Active(context); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Claims()["role"] != "admin" {
+		t.Fatal("expect claims attached to client")
+	}
+}
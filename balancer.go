@@ -0,0 +1,127 @@
+package gsproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/gsrpc/gorpc"
+)
+
+// Balancer select one backend server when several backends provide the same service
+type Balancer interface {
+	// Select select one of servers for device's request, servers is never empty
+	Select(service uint16, device *gorpc.Device, servers []Server) Server
+}
+
+// BalancerF function as Balancer
+type BalancerF func(service uint16, device *gorpc.Device, servers []Server) Server
+
+// Select implement Balancer
+func (f BalancerF) Select(service uint16, device *gorpc.Device, servers []Server) Server {
+	return f(service, device, servers)
+}
+
+func newBalancer(name string) Balancer {
+	switch name {
+	case "leastinflight":
+		return NewLeastInFlight()
+	case "hash":
+		return NewConsistentHash()
+	}
+
+	return NewRoundRobin()
+}
+
+type _RoundRobin struct {
+	sync.Mutex                   // mutex
+	next       map[uint16]uint32 // next server index of services
+}
+
+// NewRoundRobin create balancer select servers in turn per service
+func NewRoundRobin() Balancer {
+	return &_RoundRobin{
+		next: make(map[uint16]uint32),
+	}
+}
+
+func (balancer *_RoundRobin) Select(service uint16, device *gorpc.Device, servers []Server) Server {
+	balancer.Lock()
+	defer balancer.Unlock()
+
+	next := balancer.next[service]
+
+	balancer.next[service] = next + 1
+
+	return servers[next%uint32(len(servers))]
+}
+
+type _LeastInFlight struct {
+}
+
+// NewLeastInFlight create balancer select the server with the fewest requests waiting for response
+func NewLeastInFlight() Balancer {
+	return &_LeastInFlight{}
+}
+
+func (balancer *_LeastInFlight) Select(service uint16, device *gorpc.Device, servers []Server) Server {
+
+	selected := servers[0]
+
+	var least int64 = -1
+
+	for _, server := range servers {
+
+		tunnel, ok := tunnelOf(server)
+
+		if !ok {
+			continue
+		}
+
+		if inflight := tunnel.InFlight(); least < 0 || inflight < least {
+			least = inflight
+			selected = server
+		}
+	}
+
+	return selected
+}
+
+type _ConsistentHash struct {
+}
+
+// NewConsistentHash create balancer keep the same device on the same server while the
+// server set is unchanged, using rendezvous hashing so that only the devices of an
+// added or removed server move
+func NewConsistentHash() Balancer {
+	return &_ConsistentHash{}
+}
+
+func (balancer *_ConsistentHash) Select(service uint16, device *gorpc.Device, servers []Server) Server {
+
+	selected := servers[0]
+
+	var max uint64
+
+	for i, server := range servers {
+
+		node := fmt.Sprintf("%d", i)
+
+		if tunnel, ok := tunnelOf(server); ok {
+			node = fmt.Sprintf("%d", tunnel.ID())
+		}
+
+		hash := fnv.New64a()
+
+		hash.Write([]byte(device.String()))
+
+		hash.Write([]byte(node))
+
+		if weight := hash.Sum64(); i == 0 || weight > max {
+			max = weight
+			selected = server
+		}
+	}
+
+	return selected
+}
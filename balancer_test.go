@@ -0,0 +1,84 @@
+package gsproxy
+
+import (
+	"testing"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func newBalancerServers(n int) []Server {
+
+	servers := make([]Server, n)
+
+	for i := range servers {
+		servers[i] = &_MockPipeline{
+			tunnel: &_TunnelServerHandler{id: uint32(i + 1)},
+		}
+	}
+
+	return servers
+}
+
+func TestRoundRobin(t *testing.T) {
+
+	balancer := NewRoundRobin()
+
+	servers := newBalancerServers(2)
+
+	device := gorpc.NewDevice()
+
+	first := balancer.Select(1, device, servers)
+
+	second := balancer.Select(1, device, servers)
+
+	if first == second {
+		t.Fatal("expect select servers in turn")
+	}
+}
+
+func TestLeastInFlight(t *testing.T) {
+
+	balancer := NewLeastInFlight()
+
+	servers := newBalancerServers(3)
+
+	servers[0].(*_MockPipeline).tunnel.inflight = 2
+
+	servers[2].(*_MockPipeline).tunnel.inflight = 1
+
+	if balancer.Select(1, gorpc.NewDevice(), servers) != servers[1] {
+		t.Fatal("expect select the idle server")
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+
+	balancer := NewConsistentHash()
+
+	servers := newBalancerServers(4)
+
+	device := gorpc.NewDevice()
+
+	device.ID = "device"
+
+	selected := balancer.Select(1, device, servers)
+
+	for i := 0; i < 10; i++ {
+		if balancer.Select(1, device, servers) != selected {
+			t.Fatal("expect select the same server for device")
+		}
+	}
+
+	var rest []Server
+
+	for _, server := range servers {
+		if server != selected {
+			rest = append(rest, server)
+		}
+	}
+
+	// removing another server must not move the device
+	if balancer.Select(1, device, append(rest[1:], selected)) != selected {
+		t.Fatal("expect device stay on its server")
+	}
+}
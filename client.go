@@ -1,6 +1,8 @@
 package gsproxy
 
 import (
+	"time"
+
 	"github.com/gsdocker/gslogger"
 	"github.com/gsrpc/gorpc"
 	"github.com/gsrpc/gorpc/handler"
@@ -12,6 +14,8 @@ type _Client struct {
 	pipeline     gorpc.Pipeline // Mixin pipeline
 	context      *_Proxy        // proxy belongs to
 	device       *gorpc.Device  // device name
+	connected    time.Time      // connect time
+	claims       Claims         // claims attached by authenticator
 }
 
 func (proxy *_Proxy) newClientHandler() gorpc.Handler {
@@ -37,6 +41,24 @@ func (client *_Client) Active(context gorpc.Context) error {
 
 	client.device = device
 
+	client.connected = time.Now()
+
+	if auth, ok := context.Pipeline().Handler(authHandler); ok {
+		client.claims = auth.(*_AuthHandler).claims
+	}
+
+	if value, ok := client.claims[ClaimServices]; ok {
+
+		services, err := parseServiceACL(value)
+
+		if err != nil {
+			client.E("device(%s) invalid services claim %s, deny all services\n%s", device, value, err)
+			services = make([]uint16, 0)
+		}
+
+		client.SetServiceACL(services)
+	}
+
 	client.context.addClient(client)
 
 	return nil
@@ -44,6 +66,25 @@ func (client *_Client) Active(context gorpc.Context) error {
 
 func (client *_Client) Unregister(context gorpc.Context) {
 
+	if client.device != nil {
+		return
+	}
+
+	// only count pipelines closed before the dh handshake completed, auth
+	// rejects and tls handshake failures are counted elsewhere
+	dh, ok := context.Pipeline().Handler(dhHandler)
+
+	if !ok {
+		return
+	}
+
+	if _, ok := dh.(*_TLSServer); ok {
+		return
+	}
+
+	if crypto, ok := dh.(handler.CryptoServer); ok && crypto.GetDevice() == nil {
+		client.context.metrics.handshakeFailed()
+	}
 }
 
 func (client *_Client) Inactive(context gorpc.Context) {
@@ -89,15 +130,26 @@ func (client *_Client) Name() string {
 	return client.name
 }
 
+func (client *_Client) SetServiceACL(services []uint16) {
+	client.transproxy().setACL(services)
+}
+
+func (client *_Client) Claims() Claims {
+	return client.claims
+}
+
 func (client *_Client) Device() *gorpc.Device {
 	return client.device
 }
 
-func (client *_Client) TransproxyBind(id uint16, server Server) {
+func (client *_Client) transproxy() *_TransProxyHandler {
 	handler, _ := client.pipeline.Handler(transProxyHandler)
-	handler.(*_TransProxyHandler).bind(id, server)
+	return handler.(*_TransProxyHandler)
+}
+
+func (client *_Client) TransproxyBind(id uint16, server Server) {
+	client.transproxy().bind(id, server)
 }
 func (client *_Client) TransproxyUnbind(sourceid uint16) {
-	handler, _ := client.pipeline.Handler(transProxyHandler)
-	handler.(*_TransProxyHandler).unbind(sourceid)
+	client.transproxy().unbind(sourceid)
 }
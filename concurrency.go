@@ -0,0 +1,160 @@
+package gsproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// _Concurrency in-flight request limits, zero means unlimited
+type _Concurrency struct {
+	tunnel int64 // max in-flight requests per backend tunnel
+	global int64 // max in-flight requests of all backend tunnels
+	queue  int   // max queued requests per backend tunnel, zero rejects immediately
+}
+
+// available check if the tunnel can accept one more in-flight request, the
+// caller must hold the tunnel lock
+func (handler *_TunnelServerHandler) available() bool {
+
+	// proxy request ids exhausted
+	if len(handler.pending) >= 0xffff {
+		return false
+	}
+
+	limits := handler.proxy.concurrency
+
+	if limits == nil {
+		return true
+	}
+
+	if limits.tunnel > 0 && atomic.LoadInt64(&handler.inflight) >= limits.tunnel {
+		return false
+	}
+
+	if limits.global > 0 && atomic.LoadInt64(&handler.proxy.inflight) >= limits.global {
+		return false
+	}
+
+	return true
+}
+
+// admit track request if the tunnel has capacity, otherwise queue it within
+// the queue budget. returns false if the request is queued, ErrOverloaded if
+// the queue is full
+func (handler *_TunnelServerHandler) admit(pending *_PendingRequest) (bool, error) {
+	handler.Lock()
+	defer handler.Unlock()
+
+	handler.sweep(pending.sent)
+
+	if len(handler.queue) == 0 && handler.available() {
+		return true, handler.track(pending)
+	}
+
+	if limits := handler.proxy.concurrency; limits == nil || len(handler.queue) >= limits.queue {
+		handler.proxy.metrics.overloaded(handler.id)
+		return false, ErrOverloaded
+	}
+
+	handler.queue = append(handler.queue, pending)
+
+	handler.proxy.metrics.queued(handler.id, len(handler.queue))
+
+	return false, nil
+}
+
+// dequeue track queued requests while the tunnel has capacity, drop requests
+// queued longer than rpc timeout
+func (handler *_TunnelServerHandler) dequeue() []*_PendingRequest {
+	handler.Lock()
+	defer handler.Unlock()
+
+	if len(handler.queue) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	timeout := handler.proxy.timeout
+
+	var ready []*_PendingRequest
+
+	for len(handler.queue) > 0 && handler.available() {
+
+		pending := handler.queue[0]
+
+		handler.queue[0] = nil
+
+		handler.queue = handler.queue[1:]
+
+		if timeout > 0 && now.Sub(pending.sent) >= timeout {
+
+			handler.W("tunnel(%s) queued request(%d) timeout", pending.handler.device, pending.id)
+
+			handler.proxy.metrics.timedOut(pending.service, handler.id)
+
+			pending.span.Finish(ErrTimeout)
+
+			handler.proxy.access(pending, OutcomeTimeout, 0)
+
+			continue
+		}
+
+		if err := handler.track(pending); err != nil {
+			handler.E("tunnel(%s) queued request(%d) -- failed\n%s", pending.handler.device, pending.id, err)
+			pending.span.Finish(err)
+			continue
+		}
+
+		ready = append(ready, pending)
+	}
+
+	handler.proxy.metrics.queued(handler.id, len(handler.queue))
+
+	return ready
+}
+
+// QueueDepth requests waiting for tunnel capacity
+func (handler *_TunnelServerHandler) QueueDepth() int {
+	handler.Lock()
+	defer handler.Unlock()
+
+	return len(handler.queue)
+}
+
+// pump forward queued requests while the tunnel has capacity
+func (handler *_TunnelServerHandler) pump() {
+	for _, pending := range handler.dequeue() {
+		if err := pending.handler.dispatch(pending); err != nil {
+			handler.proxy.reject(pending, ExceptionTunnelClosed)
+		}
+	}
+}
+
+// release pump queued requests after in-flight requests of tunnel finished,
+// all tunnels share the capacity if global limit is set
+func (proxy *_Proxy) release(tunnel *_TunnelServerHandler) {
+
+	if proxy.concurrency == nil {
+		return
+	}
+
+	if proxy.concurrency.global <= 0 {
+		tunnel.pump()
+		return
+	}
+
+	proxy.RLock()
+
+	tunnels := make([]*_TunnelServerHandler, 0, len(proxy.tunnels))
+
+	for _, tunnel := range proxy.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+
+	proxy.RUnlock()
+
+	for _, tunnel := range tunnels {
+		tunnel.pump()
+	}
+}
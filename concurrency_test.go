@@ -0,0 +1,65 @@
+package gsproxy
+
+import (
+	"testing"
+
+	"github.com/gsdocker/gsproxy/trace"
+)
+
+func TestConcurrencyQueue(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	proxy.concurrency = &_Concurrency{tunnel: 1, queue: 1}
+
+	tunnel := servers[0].tunnel
+
+	for i := uint16(1); i <= 2; i++ {
+		if err := handler.forwardRequest(servers[0], newRequestMessage(i, 1), newPendingRequest(i, 1), trace.SpanContext{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tunnel.InFlight() != 1 || tunnel.QueueDepth() != 1 || len(servers[0].sent) != 1 {
+		t.Fatal("expect one in-flight and one queued request")
+	}
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(3, 1), newPendingRequest(3, 1), trace.SpanContext{}); err != ErrOverloaded {
+		t.Fatal("expect overloaded")
+	}
+
+	if proxy.metrics.overloads.Get("1") != 1 || proxy.metrics.queueDepth.Get("1") != 1 {
+		t.Fatal("expect overload and queue depth metrics")
+	}
+
+	context := &_MockContext{pipeline: servers[0]}
+
+	if _, err := tunnel.MessageReceived(context, newTunnelResponse(handler.device, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if tunnel.InFlight() != 1 || tunnel.QueueDepth() != 0 || len(servers[0].sent) != 2 {
+		t.Fatal("expect queued request forwarded")
+	}
+}
+
+func TestConcurrencyTunnelClosed(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.concurrency = &_Concurrency{tunnel: 1, queue: 1}
+
+	for i := uint16(1); i <= 2; i++ {
+		if err := handler.forwardRequest(servers[0], newRequestMessage(i, 1), newPendingRequest(i, 1), trace.SpanContext{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	servers[0].tunnel.Inactive(&_MockContext{pipeline: servers[0]})
+
+	if len(handler.pipeline.(*_MockPipeline).sent) != 2 {
+		t.Fatal("expect both in-flight and queued requests answered")
+	}
+}
@@ -0,0 +1,145 @@
+package gsproxy
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+// Correlation errors
+var (
+	ErrRequestID   = errors.New("gsproxy request id exhausted")
+	ErrCorrelation = errors.New("gsproxy unknown or expired response")
+)
+
+// _Correlation backend request forwarded to client waiting for response
+type _Correlation struct {
+	server Server    // backend server sent the request
+	id     uint16    // backend request id
+	expire time.Time // expire time, zero never expires
+}
+
+func (correlation *_Correlation) expired(now time.Time) bool {
+	return !correlation.expire.IsZero() && now.After(correlation.expire)
+}
+
+// correlate rewrite backend request to a proxy request id unique in this
+// client, so the client response routes back to the exact backend
+func (handler *_TransProxyHandler) correlate(server Server, message *gorpc.Message) error {
+
+	request, err := gorpc.ReadRequest(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	handler.Lock()
+
+	handler.sweep(now)
+
+	local, err := handler.requestID()
+
+	if err != nil {
+		handler.Unlock()
+		return err
+	}
+
+	correlation := &_Correlation{
+		server: server,
+		id:     request.ID,
+	}
+
+	if handler.proxy.timeout > 0 {
+		correlation.expire = now.Add(handler.proxy.timeout)
+	}
+
+	handler.correlations[local] = correlation
+
+	handler.Unlock()
+
+	request.ID = local
+
+	var buff bytes.Buffer
+
+	if err := gorpc.WriteRequest(&buff, request); err != nil {
+		return err
+	}
+
+	message.Content = buff.Bytes()
+
+	return nil
+}
+
+// respond restore client response to the backend request id, the proxy never
+// calls clients itself so responses without correlation are rejected
+func (handler *_TransProxyHandler) respond(message *gorpc.Message) (Server, error) {
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		return nil, err
+	}
+
+	handler.Lock()
+
+	correlation, ok := handler.correlations[response.ID]
+
+	if ok {
+		delete(handler.correlations, response.ID)
+	}
+
+	handler.Unlock()
+
+	if !ok || correlation.expired(time.Now()) {
+		return nil, ErrCorrelation
+	}
+
+	response.ID = correlation.id
+
+	var buff bytes.Buffer
+
+	if err := gorpc.WriteResponse(&buff, response); err != nil {
+		return nil, err
+	}
+
+	message.Content = buff.Bytes()
+
+	return correlation.server, nil
+}
+
+// requestID allocate an unused proxy request id
+func (handler *_TransProxyHandler) requestID() (uint16, error) {
+
+	for i := 0; i < 0xffff; i++ {
+		handler.idgen++
+
+		if _, ok := handler.correlations[handler.idgen]; !ok {
+			return handler.idgen, nil
+		}
+	}
+
+	return 0, ErrRequestID
+}
+
+// sweep remove expired correlations at most once per rpc timeout, correlations
+// never expire if rpc timeout is disabled
+func (handler *_TransProxyHandler) sweep(now time.Time) {
+
+	timeout := handler.proxy.timeout
+
+	if timeout <= 0 || now.Sub(handler.swept) < timeout {
+		return
+	}
+
+	handler.swept = now
+
+	for local, correlation := range handler.correlations {
+		if correlation.expired(now) {
+			delete(handler.correlations, local)
+		}
+	}
+}
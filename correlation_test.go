@@ -0,0 +1,114 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func newCorrelationResponse(id uint16) *gorpc.Message {
+
+	response := gorpc.NewResponse()
+
+	response.ID = id
+
+	var buff bytes.Buffer
+
+	gorpc.WriteResponse(&buff, response)
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeResponse
+
+	message.Content = buff.Bytes()
+
+	return message
+}
+
+func TestCorrelation(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.timeout = time.Minute
+
+	first := newRequestMessage(7, 0)
+
+	second := newRequestMessage(7, 0)
+
+	if err := handler.correlate(servers[0], first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.correlate(servers[1], second); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := gorpc.ReadRequest(bytes.NewBuffer(second.Content))
+
+	// the same backend request id from two backends must not collide
+	response := newCorrelationResponse(request.ID)
+
+	server, err := handler.respond(response)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server != servers[1] {
+		t.Fatal("expect response routed to the second backend")
+	}
+
+	restored, _ := gorpc.ReadResponse(bytes.NewBuffer(response.Content))
+
+	if restored.ID != 7 {
+		t.Fatalf("expect backend request id 7, got %d", restored.ID)
+	}
+
+	if _, err := handler.respond(newCorrelationResponse(request.ID)); err != ErrCorrelation {
+		t.Fatalf("expect ErrCorrelation for answered request, got %v", err)
+	}
+}
+
+func TestCorrelationExpired(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.timeout = time.Minute
+
+	message := newRequestMessage(1, 0)
+
+	if err := handler.correlate(servers[0], message); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := gorpc.ReadRequest(bytes.NewBuffer(message.Content))
+
+	handler.correlations[request.ID].expire = time.Now().Add(-time.Second)
+
+	if _, err := handler.respond(newCorrelationResponse(request.ID)); err != ErrCorrelation {
+		t.Fatalf("expect ErrCorrelation for expired request, got %v", err)
+	}
+}
+
+func TestCorrelationNoTimeout(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.timeout = 0
+
+	message := newRequestMessage(1, 0)
+
+	if err := handler.correlate(servers[0], message); err != nil {
+		t.Fatal(err)
+	}
+
+	request, _ := gorpc.ReadRequest(bytes.NewBuffer(message.Content))
+
+	time.Sleep(time.Millisecond)
+
+	if _, err := handler.respond(newCorrelationResponse(request.ID)); err != nil {
+		t.Fatalf("expect correlation never expires without rpc timeout, got %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 package gsagent
 
 import (
+	"crypto/tls"
+	"io"
 	"sync"
 	"time"
 
 	"github.com/gsdocker/gsconfig"
 	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/auth"
+	"github.com/gsdocker/gsproxy/metrics"
+	"github.com/gsdocker/gsproxy/trace"
 	"github.com/gsrpc/gorpc"
 )
 
@@ -44,20 +49,37 @@ type Context interface {
 
 // AgentBuilder .
 type AgentBuilder struct {
-	system     System        // agent system
-	cachedsize int           // send cached
-	timeout    time.Duration // rpc call timeout
-	reconnect  time.Duration // reconnect to gsproxy service delay time duration
+	system     System            // agent system
+	cachedsize int               // send cached
+	timeout    time.Duration     // rpc call timeout
+	reconnect  time.Duration     // reconnect to gsproxy service delay time duration
+	metrics    *metrics.Registry // metrics registry, nil disabled
+	tracer     trace.Exporter    // span exporter, nil disabled
+	signer     auth.Signer       // tunnel handshake signer, nil disabled
+	tlsCA      string            // proxy ca certificate path, tls disabled if empty with tlsCert
+	tlsCert    string            // client certificate path for mutual tls
+	tlsKey     string            // client key path for mutual tls
+	tlsServer  string            // proxy server name, host of raddr if empty
 }
 
 // BuildAgent .
 func BuildAgent(system System) *AgentBuilder {
-	return &AgentBuilder{
+	builder := &AgentBuilder{
 		system:     system,
 		cachedsize: gsconfig.Int("gsagent.rpc.sendQ", 1024),
 		timeout:    gsconfig.Seconds("gsagent.rpc.timeout", 5),
 		reconnect:  gsconfig.Seconds("gsagent.reconnect.delay", 5),
+		tlsCA:      gsconfig.String("gsagent.tls.ca", ""),
+		tlsCert:    gsconfig.String("gsagent.tls.cert", ""),
+		tlsKey:     gsconfig.String("gsagent.tls.key", ""),
+		tlsServer:  gsconfig.String("gsagent.tls.servername", ""),
 	}
+
+	if secret := gsconfig.String("gsagent.tunnel.secret", ""); secret != "" {
+		builder.signer = auth.NewHMAC([]byte(secret), 0)
+	}
+
+	return builder
 }
 
 // SendQ set send Q
@@ -91,17 +113,81 @@ type _System struct {
 	reconnect    time.Duration             // reconnect to gsproxy service delay time duration
 	cachedsize   int                       // send cached
 	tunnels      map[string]*_TunnelClient // register tunnel
+	metrics      *_Metrics                 // metrics, nil if disabled
+	tracer       trace.Exporter            // span exporter, nil if disabled
+	signer       auth.Signer               // tunnel handshake signer, nil if disabled
+	tlsCA        string                    // proxy ca certificate path
+	tlsCert      string                    // client certificate path
+	tlsKey       string                    // client key path
+	tlsServer    string                    // proxy server name
+}
+
+// Metrics register agent metrics to registry
+func (builder *AgentBuilder) Metrics(registry *metrics.Registry) *AgentBuilder {
+
+	builder.metrics = registry
+
+	return builder
+}
+
+// Tracer export spans of dispatching traced tunnel requests to exporter
+func (builder *AgentBuilder) Tracer(exporter trace.Exporter) *AgentBuilder {
+
+	builder.tracer = exporter
+
+	return builder
+}
+
+// Signer sign the tunnel handshake, the proxy must be built with the
+// matching verifier
+func (builder *AgentBuilder) Signer(signer auth.Signer) *AgentBuilder {
+
+	builder.signer = signer
+
+	return builder
+}
+
+// TLS connect to proxy over tls, verify proxy certificate with ca and present
+// cert for mutual tls if cert is not empty. empty ca uses the system roots
+func (builder *AgentBuilder) TLS(ca string, cert string, key string) *AgentBuilder {
+
+	builder.tlsCA = ca
+
+	builder.tlsCert = cert
+
+	builder.tlsKey = key
+
+	return builder
+}
+
+// TLSServerName set expected proxy certificate name, default is the host of raddr
+func (builder *AgentBuilder) TLSServerName(name string) *AgentBuilder {
+
+	builder.tlsServer = name
+
+	return builder
 }
 
 // Build .
 func (builder *AgentBuilder) Build(name string) Context {
 	context := &_System{
+		Log:        gslogger.Get("gsagent"),
 		name:       name,
 		system:     builder.system,
 		timeout:    builder.timeout,
 		reconnect:  builder.reconnect,
 		cachedsize: builder.cachedsize,
 		tunnels:    make(map[string]*_TunnelClient),
+		tracer:     builder.tracer,
+		signer:     builder.signer,
+		tlsCA:      builder.tlsCA,
+		tlsCert:    builder.tlsCert,
+		tlsKey:     builder.tlsKey,
+		tlsServer:  builder.tlsServer,
+	}
+
+	if builder.metrics != nil {
+		context.metrics = context.newMetrics(builder.metrics)
 	}
 
 	return context
@@ -152,5 +238,18 @@ func (system *_System) Connect(name string, raddr string) (gorpc.Client, error)
 
 	builder.Reconnect(system.timeout)
 
-	return gorpc.TCPConnect(builder, name, raddr)
+	config, err := loadClientTLS(system.tlsCA, system.tlsCert, system.tlsKey, system.tlsServer)
+
+	if err != nil {
+		system.E("load tunnel(%s) tls config error :%s", name, err)
+		return nil, err
+	}
+
+	if config == nil {
+		return gorpc.TCPConnect(builder, name, raddr)
+	}
+
+	return builder.Build(name, func() (io.ReadWriteCloser, error) {
+		return tls.Dial("tcp", raddr, config)
+	})
 }
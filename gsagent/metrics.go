@@ -0,0 +1,44 @@
+package gsagent
+
+import "github.com/gsdocker/gsproxy/metrics"
+
+// _Metrics agent metrics matching the gsproxy tunnel metrics, nil metrics ignores all updates
+type _Metrics struct {
+	tunnelMessages   *metrics.Counter // messages per tunnel and direction
+	tunnelBytes      *metrics.Counter // bytes per tunnel and direction
+	dispatchFailures *metrics.Counter // tunnel messages failed to dispatch to agent
+}
+
+func (system *_System) newMetrics(registry *metrics.Registry) *_Metrics {
+
+	registry.GaugeFunc("gsagent_tunnels", "connected gsproxy tunnels", func() float64 {
+		system.RLock()
+		defer system.RUnlock()
+
+		return float64(len(system.tunnels))
+	})
+
+	return &_Metrics{
+		tunnelMessages:   registry.Counter("gsagent_tunnel_messages_total", "messages through gsproxy tunnel", "tunnel", "direction"),
+		tunnelBytes:      registry.Counter("gsagent_tunnel_bytes_total", "bytes through gsproxy tunnel", "tunnel", "direction"),
+		dispatchFailures: registry.Counter("gsagent_dispatch_failures_total", "tunnel messages failed to dispatch to agent", "tunnel"),
+	}
+}
+
+func (m *_Metrics) tunneled(tunnel string, direction string, size int) {
+	if m == nil {
+		return
+	}
+
+	m.tunnelMessages.Inc(tunnel, direction)
+
+	m.tunnelBytes.Add(float64(size), tunnel, direction)
+}
+
+func (m *_Metrics) dispatchFailed(tunnel string) {
+	if m == nil {
+		return
+	}
+
+	m.dispatchFailures.Inc(tunnel)
+}
@@ -0,0 +1,52 @@
+package gsagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadClientTLS load tunnel tls config, returns nil config if ca and cert are
+// both empty. cert and key are presented to the proxy for mutual tls
+func loadClientTLS(ca string, cert string, key string, serverName string) (*tls.Config, error) {
+
+	if ca == "" && cert == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ca != "" {
+
+		content, err := ioutil.ReadFile(ca)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if cert != "" {
+
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
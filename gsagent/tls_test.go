@@ -0,0 +1,12 @@
+package gsagent
+
+import "testing"
+
+func TestTLSBadCA(t *testing.T) {
+
+	system := BuildAgent(nil).TLS("/nonexistent-ca.pem", "", "").Build("gsagent-test")
+
+	if _, err := system.Connect("gsagent-tls", "127.0.0.1:0"); err == nil {
+		t.Fatal("expect tls config error")
+	}
+}
@@ -2,13 +2,31 @@ package gsagent
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/auth"
+	"github.com/gsdocker/gsproxy/trace"
 	"github.com/gsrpc/gorpc"
 )
 
+var (
+	errTunnelClosed = errors.New("gsagent tunnel closed")
+	errSpanExpired  = errors.New("gsagent request not responded in time")
+)
+
+// spanTimeout expire time of dispatching spans if rpc timeout is disabled
+const spanTimeout = time.Minute
+
+// _DispatchSpan agent hop span waiting for agent response
+type _DispatchSpan struct {
+	span    *trace.Span // span
+	started time.Time   // dispatch time
+}
+
 type _Agent struct {
 	gorpc.Sink
 	handler *_TunnelClient
@@ -53,13 +71,15 @@ func (agent *_Agent) ID() *gorpc.Device {
 
 // _TunnelClient .
 type _TunnelClient struct {
-	sync.Mutex                      // mutex
-	gslogger.Log                    // mixin log APIs
-	name         string             // tunnel name
-	system       *_System           // system
-	context      gorpc.Context      // context
-	agents       map[string]*_Agent // agent
-	timeout      time.Duration      // rpc timeout
+	sync.Mutex                             // mutex
+	gslogger.Log                           // mixin log APIs
+	name         string                    // tunnel name
+	system       *_System                  // system
+	context      gorpc.Context             // context
+	agents       map[string]*_Agent        // agent
+	timeout      time.Duration             // rpc timeout
+	spans        map[string]*_DispatchSpan // dispatching traced requests
+	swept        time.Time                 // last spans sweep time
 }
 
 func (system *_System) newTunnelClient(name string) gorpc.Handler {
@@ -68,6 +88,8 @@ func (system *_System) newTunnelClient(name string) gorpc.Handler {
 		name:    name,
 		system:  system,
 		timeout: system.timeout,
+		spans:   make(map[string]*_DispatchSpan),
+		swept:   time.Now(),
 	}
 }
 
@@ -98,6 +120,25 @@ func (handler *_TunnelClient) Active(context gorpc.Context) error {
 
 	message.Content = buff.Bytes()
 
+	if signer := handler.system.signer; signer != nil {
+
+		credential, err := signer.Sign(message.Content)
+
+		if err != nil {
+			handler.E("sign tunnel handshake -- failed\n%s", err)
+			return err
+		}
+
+		message.Content, err = auth.Encode(credential, message.Content)
+
+		if err != nil {
+			handler.E("sign tunnel handshake -- failed\n%s", err)
+			return err
+		}
+
+		message.Agent = auth.MessageFlag
+	}
+
 	context.Send(message)
 
 	return nil
@@ -112,6 +153,18 @@ func (handler *_TunnelClient) Inactive(context gorpc.Context) {
 	}
 
 	handler.system.removeTunnel(handler.name, handler, context.Pipeline())
+
+	handler.Lock()
+
+	spans := handler.spans
+
+	handler.spans = make(map[string]*_DispatchSpan)
+
+	handler.Unlock()
+
+	for _, dispatching := range spans {
+		dispatching.span.Finish(errTunnelClosed)
+	}
 }
 
 func (handler *_TunnelClient) agent(context gorpc.Context, device *gorpc.Device) (*_Agent, error) {
@@ -137,6 +190,10 @@ func (handler *_TunnelClient) agent(context gorpc.Context, device *gorpc.Device)
 
 func (handler *_TunnelClient) SendMessage(device *gorpc.Device, message *gorpc.Message) error {
 
+	if message.Code == gorpc.CodeResponse {
+		handler.finishSpan(device, message)
+	}
+
 	tunnel := gorpc.NewTunnel()
 
 	tunnel.ID = device
@@ -155,6 +212,8 @@ func (handler *_TunnelClient) SendMessage(device *gorpc.Device, message *gorpc.M
 
 	message.Content = buff.Bytes()
 
+	handler.system.metrics.tunneled(handler.name, "backward", len(message.Content))
+
 	handler.context.Send(message)
 	return nil
 }
@@ -169,7 +228,25 @@ func (handler *_TunnelClient) MessageReceived(context gorpc.Context, message *go
 		return message, nil
 	}
 
-	tunnel, err := gorpc.ReadTunnel(bytes.NewBuffer(message.Content))
+	handler.system.metrics.tunneled(handler.name, "forward", len(message.Content))
+
+	var parent trace.SpanContext
+
+	content := message.Content
+
+	if message.Agent == trace.MessageFlag {
+
+		var err error
+
+		parent, content, err = trace.Decode(message.Content)
+
+		if content == nil {
+			handler.E("unmarshal tunnel message trace context -- failed\n%s", err)
+			return nil, err
+		}
+	}
+
+	tunnel, err := gorpc.ReadTunnel(bytes.NewBuffer(content))
 
 	if err != nil {
 		handler.E("backward tunnel(%s) message -- failed\n%s", tunnel.ID, err)
@@ -180,11 +257,25 @@ func (handler *_TunnelClient) MessageReceived(context gorpc.Context, message *go
 
 	agent, err := handler.agent(context, tunnel.ID)
 
+	var span *trace.Span
+
+	var key string
+
+	if parent.IsValid() && tunnel.Message.Code == gorpc.CodeRequest {
+		span, key = handler.startSpan(tunnel.ID, tunnel.Message, parent)
+	}
+
 	if err != nil {
 		handler.E("dispatch tunnel(%s) message -- failed\n%s", tunnel.ID, err)
+		handler.system.metrics.dispatchFailed(handler.name)
+		span.Finish(err)
 		return nil, nil
 	}
 
+	if span != nil {
+		handler.trackSpan(key, span)
+	}
+
 	go agent.MessageReceived(tunnel.Message)
 
 	return nil, nil
@@ -198,3 +289,110 @@ func (handler *_TunnelClient) MessageSending(context gorpc.Context, message *gor
 func (handler *_TunnelClient) Panic(context gorpc.Context, err error) {
 
 }
+
+// startSpan start the agent hop span of traced request, returns nil span if
+// tracing is disabled
+func (handler *_TunnelClient) startSpan(device *gorpc.Device, message *gorpc.Message, parent trace.SpanContext) (*trace.Span, string) {
+
+	if handler.system.tracer == nil {
+		return nil, ""
+	}
+
+	request, err := gorpc.ReadRequest(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		return nil, ""
+	}
+
+	span := trace.Start(handler.system.tracer, "gsagent.dispatch", parent)
+
+	span.Set("device", device)
+
+	span.Set("service", request.Service)
+
+	span.Set("tunnel", handler.name)
+
+	return span, fmt.Sprintf("%s:%d", device, request.ID)
+}
+
+// trackSpan track the dispatching span until the agent responds
+func (handler *_TunnelClient) trackSpan(key string, span *trace.Span) {
+
+	now := time.Now()
+
+	handler.Lock()
+
+	expired := handler.sweep(now)
+
+	if previous, ok := handler.spans[key]; ok {
+		expired = append(expired, previous.span)
+	}
+
+	handler.spans[key] = &_DispatchSpan{span: span, started: now}
+
+	handler.Unlock()
+
+	for _, span := range expired {
+		span.Finish(errSpanExpired)
+	}
+}
+
+// sweep remove spans the agent never responded at most once per timeout,
+// the caller must hold the lock
+func (handler *_TunnelClient) sweep(now time.Time) []*trace.Span {
+
+	timeout := handler.timeout
+
+	if timeout <= 0 {
+		timeout = spanTimeout
+	}
+
+	if now.Sub(handler.swept) < timeout {
+		return nil
+	}
+
+	handler.swept = now
+
+	var expired []*trace.Span
+
+	for key, dispatching := range handler.spans {
+
+		if now.Sub(dispatching.started) < timeout {
+			continue
+		}
+
+		delete(handler.spans, key)
+
+		expired = append(expired, dispatching.span)
+	}
+
+	return expired
+}
+
+// finishSpan finish the agent hop span when agent responds
+func (handler *_TunnelClient) finishSpan(device *gorpc.Device, message *gorpc.Message) {
+
+	if handler.system.tracer == nil {
+		return
+	}
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		return
+	}
+
+	key := fmt.Sprintf("%s:%d", device, response.ID)
+
+	handler.Lock()
+
+	dispatching, ok := handler.spans[key]
+
+	delete(handler.spans, key)
+
+	handler.Unlock()
+
+	if ok {
+		dispatching.span.Finish(nil)
+	}
+}
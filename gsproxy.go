@@ -1,17 +1,45 @@
 package gsproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/big"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gsdocker/gsconfig"
 	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/auth"
+	"github.com/gsdocker/gsproxy/metrics"
+	"github.com/gsdocker/gsproxy/trace"
 	"github.com/gsrpc/gorpc"
 	"github.com/gsrpc/gorpc/handler"
 )
 
+// Errors .
+var (
+	ErrClosed   = errors.New("gsproxy closed")
+	ErrTunnelID = errors.New("gsproxy tunnel id exhausted")
+	ErrTimeout  = errors.New("gsproxy request timeout")
+	// ErrTunnelClosed backend tunnel closed before responding
+	ErrTunnelClosed = errors.New("gsproxy tunnel closed")
+	// ErrRateLimited client request exceeds rate limit
+	ErrRateLimited = errors.New("gsproxy rate limited")
+	// ErrOverloaded backend tunnel saturated and request queue full
+	ErrOverloaded = errors.New("gsproxy backend overloaded")
+	// ErrMaxConns frontend connections reach max concurrent connections
+	ErrMaxConns = errors.New("gsproxy too many connections")
+	// ErrMaxConnsPerIP frontend connections of source ip reach the per ip cap
+	ErrMaxConnsPerIP = errors.New("gsproxy too many connections from source ip")
+	// ErrHandshakeRate new frontend connections exceed handshake rate
+	ErrHandshakeRate = errors.New("gsproxy handshake rate exceeded")
+)
+
 var (
 	dhHandler         = "gsproxy-dh"
 	transProxyHandler = "gsproxy-trans"
@@ -21,10 +49,30 @@ var (
 // Context .
 type Context interface {
 	String() string
-	// Close close proxy
+	// Close close proxy, wait in-flight requests until the drain timeout
 	Close()
+	// Shutdown close proxy, wait in-flight requests until ctx done
+	Shutdown(ctx context.Context) error
 	// get frontend acceptor
 	Acceptor() *gorpc.Acceptor
+	// AddrF get frontend bound address
+	AddrF() net.Addr
+	// AddrB get backend bound address
+	AddrB() net.Addr
+	// FilterF frontend peer filter, Reload it to change the lists at runtime
+	FilterF() *IPFilter
+	// FilterB backend peer filter, Reload it to change the lists at runtime
+	FilterB() *IPFilter
+	// DHKeyStore dh key store, nil if proxy is not built with one
+	DHKeyStore() *DHKeyStore
+	// Online check if device is connected
+	Online(device *gorpc.Device) bool
+	// Metrics get metrics registry, nil if metrics disabled
+	Metrics() *metrics.Registry
+	// ServiceLatency get backend latency of service, zero if metrics disabled
+	ServiceLatency(service uint16) Latency
+	// TunnelLatency get backend latency of tunnel, zero if metrics disabled
+	TunnelLatency(tunnel uint32) Latency
 }
 
 // Server server
@@ -35,12 +83,17 @@ type Client interface {
 	AddService(dispatcher gorpc.Dispatcher)
 
 	RemoveService(dispatcher gorpc.Dispatcher)
-	// TransproxyBind bind transproxy service by id
+	// TransproxyBind bind transproxy service by id, overrides the service table
 	TransproxyBind(id uint16, server Server)
 	// Unbind unbind transproxy service by id
 	TransproxyUnbind(id uint16)
 	// Device get device name
 	Device() *gorpc.Device
+	// Claims get claims attached by Authenticator, nil if not authenticated
+	Claims() Claims
+	// SetServiceACL restrict services client may call, nil removes the
+	// restriction and empty slice denies all services
+	SetServiceACL(services []uint16)
 }
 
 // Proxy .
@@ -59,13 +112,91 @@ type Proxy interface {
 	RemoveClient(context Context, client Client)
 }
 
+// LoginPolicy duplicate device login policy
+type LoginPolicy int
+
+// Login policies
+const (
+	// LoginKickOld close the online session and keep the newcomer
+	LoginKickOld LoginPolicy = iota
+	// LoginRejectNew keep the online session and close the newcomer
+	LoginRejectNew
+	// LoginAllowMultiple keep all sessions of the same device
+	LoginAllowMultiple
+)
+
+func (policy LoginPolicy) String() string {
+	switch policy {
+	case LoginKickOld:
+		return "kick"
+	case LoginRejectNew:
+		return "reject"
+	case LoginAllowMultiple:
+		return "multiple"
+	}
+
+	return fmt.Sprintf("LoginPolicy(%d)", int(policy))
+}
+
+func parseLoginPolicy(name string) LoginPolicy {
+	switch name {
+	case "reject":
+		return LoginRejectNew
+	case "multiple":
+		return LoginAllowMultiple
+	}
+
+	return LoginKickOld
+}
+
+// LoginListener optional Proxy extension, notified when a device logins again
+// while it has online sessions
+type LoginListener interface {
+	// DuplicateLogin report the policy applied to the newcomer client
+	DuplicateLogin(context Context, client Client, online []Client, policy LoginPolicy)
+}
+
 // ProxyBuilder gsproxy builder
 type ProxyBuilder struct {
-	laddrF        string                // frontend tcp listen address
-	laddrE        string                // backend tcp listen address
-	timeout       time.Duration         // rpc timeout
-	dhkeyResolver handler.DHKeyResolver // dhkey resolver
-	proxy         Proxy                 // proxy provider
+	laddrF         string                // frontend tcp listen address
+	laddrE         string                // backend tcp listen address
+	timeout        time.Duration         // rpc timeout
+	drain          time.Duration         // close drain timeout
+	maxTunnels     int                   // max concurrent backend tunnels
+	login          LoginPolicy           // duplicate login policy
+	balancer       Balancer              // backend balancer
+	affinity       time.Duration         // sticky session ttl, 0 disabled
+	idempotent     map[uint16]bool       // services safe to retry
+	laddrA         string                // admin http listen address, empty disabled
+	tokenA         string                // admin api bearer token, empty only allows loopback address
+	laddrM         string                // metrics http listen address, empty disabled
+	metrics        bool                  // metrics enabled
+	tracer         trace.Exporter        // span exporter, nil disabled
+	accessSink     AccessSink            // access log sink, nil disabled
+	accessPath     string                // access log file path, used if sink is nil
+	accessSize     int64                 // access log file max size in bytes
+	accessBackups  int                   // access log rotated files
+	limiter        *_RateLimiter         // frontend rate limit config
+	concurrency    *_Concurrency         // backend in-flight request limits
+	maxConns       int                   // max concurrent frontend connections
+	maxConnsPerIP  int                   // max concurrent frontend connections per source ip
+	handshakeRate  RateLimit             // new frontend connection rate
+	allowF         []string              // frontend allowed peer CIDRs
+	denyF          []string              // frontend denied peer CIDRs
+	allowB         []string              // backend allowed peer CIDRs
+	denyB          []string              // backend denied peer CIDRs
+	verifier       auth.Verifier         // backend tunnel handshake verifier, nil disabled
+	tlsCertB       string                // backend tls certificate path, tls disabled if empty
+	tlsKeyB        string                // backend tls key path
+	tlsClientCAB   string                // backend agent ca path, mutual tls if not empty
+	tlsCertF       string                // frontend tls certificate path, dh handshake if empty
+	tlsKeyF        string                // frontend tls key path
+	tlsClientCAF   string                // frontend client ca path, client certificate required if not empty
+	tlsIdentifierF TLSIdentifier         // frontend tls device identifier
+	dhkeyResolver  handler.DHKeyResolver // dhkey resolver
+	dhkeyStore     string                // dh key store file path, overrides G/P if not empty
+	authenticator  Authenticator         // device authenticator, nil admits all devices
+	proxy          Proxy                 // proxy provider
 }
 
 // BuildProxy create new proxy builder
@@ -78,7 +209,7 @@ func BuildProxy(proxy Proxy) *ProxyBuilder {
 
 	P, _ := new(big.Int).SetString(pStr, 0)
 
-	return &ProxyBuilder{
+	builder := &ProxyBuilder{
 
 		laddrF: gsconfig.String("gsproxy.frontend.laddr", ":13512"),
 
@@ -86,12 +217,96 @@ func BuildProxy(proxy Proxy) *ProxyBuilder {
 
 		timeout: gsconfig.Seconds("gsproxy.rpc.timeout", 5),
 
+		drain: gsconfig.Seconds("gsproxy.close.drain", 5),
+
+		maxTunnels: gsconfig.Int("gsproxy.backend.tunnels", 255),
+
+		login: parseLoginPolicy(gsconfig.String("gsproxy.frontend.login", "kick")),
+
+		balancer: newBalancer(gsconfig.String("gsproxy.backend.balancer", "roundrobin")),
+
+		affinity: gsconfig.Seconds("gsproxy.backend.affinity", 0),
+
+		idempotent: make(map[uint16]bool),
+
+		laddrA: gsconfig.String("gsproxy.admin.laddr", ""),
+
+		tokenA: gsconfig.String("gsproxy.admin.token", ""),
+
+		laddrM: gsconfig.String("gsproxy.metrics.laddr", ""),
+
+		metrics: gsconfig.Bool("gsproxy.metrics", false),
+
+		accessPath: gsconfig.String("gsproxy.accesslog.path", ""),
+
+		accessSize: int64(gsconfig.Int("gsproxy.accesslog.maxsize", 100)) * 1024 * 1024,
+
+		accessBackups: gsconfig.Int("gsproxy.accesslog.backups", 5),
+
+		limiter: &_RateLimiter{
+			device: RateLimit{
+				Rate:  float64(gsconfig.Int("gsproxy.ratelimit.device.rate", 0)),
+				Burst: gsconfig.Int("gsproxy.ratelimit.device.burst", 0),
+			},
+			service: RateLimit{
+				Rate:  float64(gsconfig.Int("gsproxy.ratelimit.service.rate", 0)),
+				Burst: gsconfig.Int("gsproxy.ratelimit.service.burst", 0),
+			},
+			services:   make(map[uint16]RateLimit),
+			disconnect: gsconfig.Bool("gsproxy.ratelimit.disconnect", false),
+		},
+
+		concurrency: &_Concurrency{
+			tunnel: int64(gsconfig.Int("gsproxy.backend.concurrency", 0)),
+			global: int64(gsconfig.Int("gsproxy.concurrency", 0)),
+			queue:  gsconfig.Int("gsproxy.backend.queue", 0),
+		},
+
+		maxConns: gsconfig.Int("gsproxy.frontend.maxconns", 0),
+
+		maxConnsPerIP: gsconfig.Int("gsproxy.frontend.maxconnsperip", 0),
+
+		handshakeRate: RateLimit{
+			Rate:  float64(gsconfig.Int("gsproxy.frontend.handshake.rate", 0)),
+			Burst: gsconfig.Int("gsproxy.frontend.handshake.burst", 0),
+		},
+
+		allowF: splitCIDRs(gsconfig.String("gsproxy.frontend.allow", "")),
+
+		denyF: splitCIDRs(gsconfig.String("gsproxy.frontend.deny", "")),
+
+		allowB: splitCIDRs(gsconfig.String("gsproxy.backend.allow", "")),
+
+		denyB: splitCIDRs(gsconfig.String("gsproxy.backend.deny", "")),
+
+		tlsCertB: gsconfig.String("gsproxy.backend.tls.cert", ""),
+
+		tlsKeyB: gsconfig.String("gsproxy.backend.tls.key", ""),
+
+		tlsClientCAB: gsconfig.String("gsproxy.backend.tls.clientca", ""),
+
+		tlsCertF: gsconfig.String("gsproxy.frontend.tls.cert", ""),
+
+		tlsKeyF: gsconfig.String("gsproxy.frontend.tls.key", ""),
+
+		tlsClientCAF: gsconfig.String("gsproxy.frontend.tls.clientca", ""),
+
+		tlsIdentifierF: CertIdentifier(),
+
+		dhkeyStore: gsconfig.String("gsproxy.dhkey.store", ""),
+
 		dhkeyResolver: handler.DHKeyResolve(func(device *gorpc.Device) (*handler.DHKey, error) {
 			return handler.NewDHKey(G, P), nil
 		}),
 
 		proxy: proxy,
 	}
+
+	if secret := gsconfig.String("gsproxy.backend.secret", ""); secret != "" {
+		builder.verifier = auth.NewHMAC([]byte(secret), gsconfig.Seconds("gsproxy.backend.secret.window", 300))
+	}
+
+	return builder
 }
 
 // AddrF set frontend listen address
@@ -106,39 +321,375 @@ func (builder *ProxyBuilder) AddrB(laddr string) *ProxyBuilder {
 	return builder
 }
 
+// AddrA set admin http listen address, empty disables the admin api. the
+// admin api can kick devices, so non-loopback addresses require AdminToken
+func (builder *ProxyBuilder) AddrA(laddr string) *ProxyBuilder {
+	builder.laddrA = laddr
+	return builder
+}
+
+// AdminToken require admin api requests carry header
+// "Authorization: Bearer <token>"
+func (builder *ProxyBuilder) AdminToken(token string) *ProxyBuilder {
+	builder.tokenA = token
+	return builder
+}
+
+// Metrics enable metrics, also export them in prometheus text format on laddr
+// if laddr is not empty
+func (builder *ProxyBuilder) Metrics(laddr string) *ProxyBuilder {
+	builder.metrics = true
+	builder.laddrM = laddr
+	return builder
+}
+
+// Tracer enable tracing, spans of the proxy hop are exported to exporter and
+// the trace context is propagated to gsagent
+func (builder *ProxyBuilder) Tracer(exporter trace.Exporter) *ProxyBuilder {
+	builder.tracer = exporter
+	return builder
+}
+
+// AccessLog write one record per proxied request to sink
+func (builder *ProxyBuilder) AccessLog(sink AccessSink) *ProxyBuilder {
+	builder.accessSink = sink
+	return builder
+}
+
+// AccessLogFile write json lines access log to rotate file
+func (builder *ProxyBuilder) AccessLogFile(path string, maxSize int64, backups int) *ProxyBuilder {
+	builder.accessPath = path
+	builder.accessSize = maxSize
+	builder.accessBackups = backups
+	return builder
+}
+
+// RateLimit set per device request rate limit, zero rate disables it
+func (builder *ProxyBuilder) RateLimit(rate float64, burst int) *ProxyBuilder {
+	builder.limiter.device = RateLimit{Rate: rate, Burst: burst}
+	return builder
+}
+
+// ServiceRateLimit set per device rate limit of service, zero rate disables it
+func (builder *ProxyBuilder) ServiceRateLimit(service uint16, rate float64, burst int) *ProxyBuilder {
+	builder.limiter.services[service] = RateLimit{Rate: rate, Burst: burst}
+	return builder
+}
+
+// RateLimitDisconnect close the client connection on exceeding rate limit
+// instead of responding ExceptionRateLimited
+func (builder *ProxyBuilder) RateLimitDisconnect(flag bool) *ProxyBuilder {
+	builder.limiter.disconnect = flag
+	return builder
+}
+
+// Concurrency set max in-flight requests per backend tunnel and of all
+// backend tunnels, zero means unlimited
+func (builder *ProxyBuilder) Concurrency(tunnel int, global int) *ProxyBuilder {
+	builder.concurrency.tunnel = int64(tunnel)
+	builder.concurrency.global = int64(global)
+	return builder
+}
+
+// ConcurrencyQueue set max requests queued per saturated backend tunnel,
+// requests beyond the queue are answered with ExceptionOverloaded
+func (builder *ProxyBuilder) ConcurrencyQueue(size int) *ProxyBuilder {
+	builder.concurrency.queue = size
+	return builder
+}
+
+// MaxConns set max concurrent frontend connections, zero means unlimited
+func (builder *ProxyBuilder) MaxConns(max int) *ProxyBuilder {
+	builder.maxConns = max
+	return builder
+}
+
+// MaxConnsPerIP set max concurrent frontend connections per source ip, zero
+// means unlimited
+func (builder *ProxyBuilder) MaxConnsPerIP(max int) *ProxyBuilder {
+	builder.maxConnsPerIP = max
+	return builder
+}
+
+// HandshakeRate set max new frontend connections per second, connections over
+// the limits are closed before the dh handshake
+func (builder *ProxyBuilder) HandshakeRate(rate float64, burst int) *ProxyBuilder {
+	builder.handshakeRate = RateLimit{Rate: rate, Burst: burst}
+	return builder
+}
+
+// FilterF set frontend peer CIDR allow and deny lists
+func (builder *ProxyBuilder) FilterF(allow []string, deny []string) *ProxyBuilder {
+	builder.allowF = allow
+	builder.denyF = deny
+	return builder
+}
+
+// FilterB set backend peer CIDR allow and deny lists
+func (builder *ProxyBuilder) FilterB(allow []string, deny []string) *ProxyBuilder {
+	builder.allowB = allow
+	builder.denyB = deny
+	return builder
+}
+
+// TunnelVerifier require backend agents to authenticate the tunnel handshake
+func (builder *ProxyBuilder) TunnelVerifier(verifier auth.Verifier) *ProxyBuilder {
+	builder.verifier = verifier
+	return builder
+}
+
+// TLSB serve backend tunnels over tls, agents must present certificate signed
+// by clientCA if clientCA is not empty
+func (builder *ProxyBuilder) TLSB(cert string, key string, clientCA string) *ProxyBuilder {
+	builder.tlsCertB = cert
+	builder.tlsKeyB = key
+	builder.tlsClientCAB = clientCA
+	return builder
+}
+
+// TLSF terminate tls on frontend instead of the dh handshake, clients must
+// present certificate signed by clientCA if clientCA is not empty
+func (builder *ProxyBuilder) TLSF(cert string, key string, clientCA string) *ProxyBuilder {
+	builder.tlsCertF = cert
+	builder.tlsKeyF = key
+	builder.tlsClientCAF = clientCA
+	return builder
+}
+
+// TLSIdentifier set device identifier of tls frontend, default CertIdentifier
+// which requires the clientCA of TLSF
+func (builder *ProxyBuilder) TLSIdentifier(identifier TLSIdentifier) *ProxyBuilder {
+	builder.tlsIdentifierF = identifier
+	return builder
+}
+
 // Heartbeat .
 func (builder *ProxyBuilder) Heartbeat(timeout time.Duration) *ProxyBuilder {
 	builder.timeout = timeout
 	return builder
 }
 
+// Drain set the max time Close waits for in-flight requests
+func (builder *ProxyBuilder) Drain(timeout time.Duration) *ProxyBuilder {
+	builder.drain = timeout
+	return builder
+}
+
+// MaxTunnels set max concurrent backend tunnels
+func (builder *ProxyBuilder) MaxTunnels(max int) *ProxyBuilder {
+	builder.maxTunnels = max
+	return builder
+}
+
+// Login set duplicate device login policy
+func (builder *ProxyBuilder) Login(policy LoginPolicy) *ProxyBuilder {
+	builder.login = policy
+	return builder
+}
+
+// Balancer set the balancer used when several backends provide the same service
+func (builder *ProxyBuilder) Balancer(balancer Balancer) *ProxyBuilder {
+	builder.balancer = balancer
+	return builder
+}
+
+// Affinity keep routing a device to the same backend of a service until the
+// assignment is idle for ttl or the backend tunnel goes away, 0 disables it
+func (builder *ProxyBuilder) Affinity(ttl time.Duration) *ProxyBuilder {
+	builder.affinity = ttl
+	return builder
+}
+
+// Idempotent mark services safe to retry on another backend when the backend
+// tunnel closed before responding
+func (builder *ProxyBuilder) Idempotent(services ...uint16) *ProxyBuilder {
+	for _, service := range services {
+		builder.idempotent[service] = true
+	}
+	return builder
+}
+
 // DHKeyResolver set frontend dhkey resolver
 func (builder *ProxyBuilder) DHKeyResolver(dhkeyResolver handler.DHKeyResolver) *ProxyBuilder {
 	builder.dhkeyResolver = dhkeyResolver
+	builder.dhkeyStore = ""
+	return builder
+}
+
+// Authenticator authenticate devices after the handshake before they are
+// reported to Proxy.AddClient
+func (builder *ProxyBuilder) Authenticator(authenticator Authenticator) *ProxyBuilder {
+	builder.authenticator = authenticator
+	return builder
+}
+
+// DHKeyStore resolve dh parameters from key store file, reload it through
+// Context.DHKeyStore
+func (builder *ProxyBuilder) DHKeyStore(path string) *ProxyBuilder {
+	builder.dhkeyStore = path
 	return builder
 }
 
 type _Proxy struct {
-	sync.RWMutex                     // mutex
-	gslogger.Log                     // mixin log APIs
-	name         string              //proxy name
-	frontend     *gorpc.Acceptor     // frontend
-	backend      *gorpc.Acceptor     // backend
-	proxy        Proxy               // proxy implement
-	clients      map[string]*_Client // handle agent clients
-	idgen        byte                // tunnel id gen
-	tunnels      map[byte]byte       // tunnels
-}
-
-// Build .
+	sync.RWMutex                                   // mutex
+	gslogger.Log                                   // mixin log APIs
+	name          string                           //proxy name
+	frontend      *gorpc.Acceptor                  // frontend
+	backend       *gorpc.Acceptor                  // backend
+	proxy         Proxy                            // proxy implement
+	clients       map[string][]*_Client            // handle agent clients, newest session last
+	login         LoginPolicy                      // duplicate login policy
+	idgen         uint32                           // tunnel id gen
+	maxTunnels    uint32                           // max concurrent tunnels
+	tunnels       map[uint32]*_TunnelServerHandler // tunnels
+	servers       map[uint32]Server                // handshaked backend servers
+	router        *_Router                         // service table
+	listenerF     net.Listener                     // frontend listener
+	listenerB     net.Listener                     // backend listener
+	admin         *http.Server                     // admin http server
+	exporter      *http.Server                     // metrics http server
+	metrics       *_Metrics                        // metrics, nil if disabled
+	tracer        trace.Exporter                   // span exporter, nil if disabled
+	accessSink    AccessSink                       // access log sink, nil if disabled
+	accessFile    *RotateFile                      // access log file opened by proxy
+	limiter       *_RateLimiter                    // frontend rate limit config
+	buckets       _BucketTable                     // frontend rate limit buckets of devices
+	concurrency   *_Concurrency                    // backend in-flight request limits
+	filterF       *IPFilter                        // frontend peer filter
+	filterB       *IPFilter                        // backend peer filter
+	verifier      auth.Verifier                    // backend tunnel handshake verifier
+	tlsStates     map[string]*tls.ConnectionState  // frontend tls states waiting for pipeline register
+	dhkeyStore    *DHKeyStore                      // dh key store, nil if not used
+	authenticator Authenticator                    // device authenticator
+	closed        bool                             // closed flag
+	closeOnce     sync.Once                        // close once
+	drain         time.Duration                    // close drain timeout
+	inflight      int64                            // in-flight tunnel requests
+	idempotent    map[uint16]bool                  // services safe to retry
+	timeout       time.Duration                    // rpc timeout
+	sweeper       chan struct{}                    // pending requests sweeper stop channel, nil if not running
+}
+
+// Build create and start proxy, startup errors are only logged and the
+// returned proxy does not serve, use BuildE to get them
 func (builder *ProxyBuilder) Build(name string) Context {
 
-	proxy := &_Proxy{
-		Log:     gslogger.Get("gsproxy"),
-		proxy:   builder.proxy,
-		clients: make(map[string]*_Client),
-		name:    name,
-		tunnels: make(map[byte]byte),
+	proxy, err := builder.build(name)
+
+	if err != nil {
+		proxy.E("build proxy %s error :%s", name, err)
+
+		// the failed proxy already released its resources
+		proxy.closeOnce.Do(func() {
+			proxy.closed = true
+		})
+	}
+
+	return proxy
+}
+
+// newProxy create proxy state without acceptors and listeners
+func (builder *ProxyBuilder) newProxy(name string) *_Proxy {
+
+	return &_Proxy{
+		Log:           gslogger.Get("gsproxy"),
+		proxy:         builder.proxy,
+		clients:       make(map[string][]*_Client),
+		login:         builder.login,
+		idempotent:    builder.idempotent,
+		timeout:       builder.timeout,
+		tracer:        builder.tracer,
+		accessSink:    builder.accessSink,
+		limiter:       builder.limiter,
+		concurrency:   builder.concurrency,
+		verifier:      builder.verifier,
+		authenticator: builder.authenticator,
+		name:          name,
+		tunnels:       make(map[uint32]*_TunnelServerHandler),
+		tlsStates:     make(map[string]*tls.ConnectionState),
+		servers:       make(map[uint32]Server),
+		drain:         builder.drain,
+		maxTunnels:    uint32(builder.maxTunnels),
+	}
+}
+
+// BuildE create proxy and bind both listeners before returning,
+// returns error if Proxy.Register or listen failed
+func (builder *ProxyBuilder) BuildE(name string) (Context, error) {
+
+	proxy, err := builder.build(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+// build create and start proxy, returns the proxy even if startup failed
+func (builder *ProxyBuilder) build(name string) (*_Proxy, error) {
+
+	proxy := builder.newProxy(name)
+
+	var affinity *_Affinity
+
+	if builder.affinity > 0 {
+		affinity = newAffinity(builder.affinity)
+		affinity.failover = proxy.failover
+	}
+
+	proxy.router = newRouter(builder.balancer, affinity)
+
+	if builder.metrics || builder.laddrM != "" {
+		proxy.metrics = proxy.newMetrics()
+	}
+
+	var err error
+
+	if proxy.filterF, err = NewIPFilter(builder.allowF, builder.denyF); err != nil {
+		return proxy, err
+	}
+
+	if proxy.filterB, err = NewIPFilter(builder.allowB, builder.denyB); err != nil {
+		return proxy, err
+	}
+
+	tlsB, err := loadServerTLS(builder.tlsCertB, builder.tlsKeyB, builder.tlsClientCAB)
+
+	if err != nil {
+		proxy.E("load backend tls config error :%s", err)
+		return proxy, err
+	}
+
+	dhkeyResolver := builder.dhkeyResolver
+
+	if builder.dhkeyStore != "" {
+
+		proxy.dhkeyStore, err = NewDHKeyStore(builder.dhkeyStore)
+
+		if err != nil {
+			proxy.E("load dh key store %s error :%s", builder.dhkeyStore, err)
+			return proxy, err
+		}
+
+		dhkeyResolver = proxy.dhkeyStore
+	}
+
+	tlsF, err := loadServerTLS(builder.tlsCertF, builder.tlsKeyF, builder.tlsClientCAF)
+
+	if err != nil {
+		proxy.E("load frontend tls config error :%s", err)
+		return proxy, err
+	}
+
+	if tlsF != nil {
+
+		if _, ok := builder.tlsIdentifierF.(_CertIdentifier); ok && tlsF.ClientCAs == nil {
+			proxy.E("frontend tls error :%s", ErrTLSClientCA)
+			return proxy, ErrTLSClientCA
+		}
+
+		proxy.I("frontend terminates tls, dh handshake disabled")
 	}
 
 	proxy.frontend = gorpc.NewAcceptor(
@@ -152,10 +703,20 @@ func (builder *ProxyBuilder) Build(name string) Context {
 				return handler.NewHeartbeatHandler(builder.timeout)
 			},
 		).Handler(
-			"gsproxy-dh",
+			dhHandler,
 			func() gorpc.Handler {
-				return handler.NewCryptoServer(builder.dhkeyResolver)
+				if tlsF != nil {
+					return proxy.newTLSServer(builder.tlsIdentifierF)
+				}
+
+				return handler.NewCryptoServer(dhkeyResolver)
 			},
+		).Handler(
+			authHandler,
+			proxy.newAuthHandler,
+		).Handler(
+			rateLimitHandler,
+			proxy.newRateLimitHandler,
 		).Handler(
 			transProxyHandler,
 			proxy.newTransProxyHandler,
@@ -173,19 +734,87 @@ func (builder *ProxyBuilder) Build(name string) Context {
 		),
 	)
 
-	go func() {
-		if err := gorpc.TCPListen(proxy.backend, builder.laddrE); err != nil {
-			proxy.E("start agent backend error :%s", err)
+	if err := proxy.proxy.Register(proxy); err != nil {
+		return proxy, err
+	}
+
+	proxy.listenerB, err = net.Listen("tcp", builder.laddrE)
+
+	if err != nil {
+		proxy.E("start agent backend error :%s", err)
+		proxy.proxy.Unregister(proxy)
+		return proxy, err
+	}
+
+	if tlsB != nil {
+		proxy.listenerB = tls.NewListener(proxy.listenerB, tlsB)
+	}
+
+	proxy.listenerF, err = net.Listen("tcp", builder.laddrF)
+
+	if err != nil {
+		proxy.E("start agent frontend error :%s", err)
+		proxy.closeListeners()
+		proxy.proxy.Unregister(proxy)
+		return proxy, err
+	}
+
+	if tlsF != nil {
+		proxy.listenerF = tls.NewListener(proxy.listenerF, tlsF)
+	}
+
+	if builder.laddrA != "" {
+
+		if builder.tokenA == "" && !loopback(builder.laddrA) {
+			proxy.E("start agent admin on %s error :%s", builder.laddrA, ErrAdminToken)
+			proxy.closeListeners()
+			proxy.proxy.Unregister(proxy)
+			return proxy, ErrAdminToken
 		}
-	}()
 
-	go func() {
-		if err := gorpc.TCPListen(proxy.frontend, builder.laddrF); err != nil {
-			proxy.E("start agent frontend error :%s", err)
+		proxy.admin, err = proxy.serveHTTP(builder.laddrA, proxy.adminHandler(builder.tokenA))
+
+		if err != nil {
+			proxy.E("start agent admin error :%s", err)
+			proxy.closeListeners()
+			proxy.proxy.Unregister(proxy)
+			return proxy, err
 		}
-	}()
+	}
 
-	return proxy
+	if builder.laddrM != "" {
+
+		proxy.exporter, err = proxy.serveHTTP(builder.laddrM, proxy.metrics.registry)
+
+		if err != nil {
+			proxy.E("start agent metrics error :%s", err)
+			proxy.closeListeners()
+			proxy.proxy.Unregister(proxy)
+			return proxy, err
+		}
+	}
+
+	if proxy.accessSink == nil && builder.accessPath != "" {
+
+		proxy.accessFile, err = NewRotateFile(builder.accessPath, builder.accessSize, builder.accessBackups)
+
+		if err != nil {
+			proxy.E("open access log %s error :%s", builder.accessPath, err)
+			proxy.closeListeners()
+			proxy.proxy.Unregister(proxy)
+			return proxy, err
+		}
+
+		proxy.accessSink = NewJSONSink(proxy.accessFile)
+	}
+
+	go proxy.accept("backend", proxy.backend, proxy.listenerB, proxy.filterB, nil, false)
+
+	go proxy.accept("frontend", proxy.frontend, proxy.listenerF, proxy.filterF, newAdmission(builder.maxConns, builder.maxConnsPerIP, builder.handshakeRate), tlsF != nil)
+
+	proxy.startSweeper()
+
+	return proxy, nil
 }
 
 func (proxy *_Proxy) Acceptor() *gorpc.Acceptor {
@@ -196,68 +825,409 @@ func (proxy *_Proxy) String() string {
 	return proxy.name
 }
 
+func (proxy *_Proxy) AddrF() net.Addr {
+
+	if proxy.listenerF == nil {
+		return nil
+	}
+
+	return proxy.listenerF.Addr()
+}
+
+func (proxy *_Proxy) FilterF() *IPFilter {
+	return proxy.filterF
+}
+
+func (proxy *_Proxy) FilterB() *IPFilter {
+	return proxy.filterB
+}
+
+func (proxy *_Proxy) DHKeyStore() *DHKeyStore {
+	return proxy.dhkeyStore
+}
+
+func (proxy *_Proxy) AddrB() net.Addr {
+
+	if proxy.listenerB == nil {
+		return nil
+	}
+
+	return proxy.listenerB.Addr()
+}
+
+func (proxy *_Proxy) serveHTTP(laddr string, handler http.Handler) (*http.Server, error) {
+
+	listener, err := net.Listen("tcp", laddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: handler}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			proxy.E("serve http on %s error :%s", listener.Addr(), err)
+		}
+	}()
+
+	return server, nil
+}
+
+// closeListeners stop accepting frontend, backend and http connections
+func (proxy *_Proxy) closeListeners() {
+
+	if proxy.listenerF != nil {
+		proxy.listenerF.Close()
+	}
+
+	if proxy.listenerB != nil {
+		proxy.listenerB.Close()
+	}
+
+	if proxy.admin != nil {
+		proxy.admin.Close()
+	}
+
+	if proxy.exporter != nil {
+		proxy.exporter.Close()
+	}
+}
+
+// accept serve listener, terminate completes the tls handshake before the
+// pipeline is created so the tls server handler can read the connection state
+func (proxy *_Proxy) accept(side string, acceptor *gorpc.Acceptor, listener net.Listener, filter *IPFilter, admission *_Admission, terminate bool) {
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+
+			if !proxy.isClosed() {
+				proxy.E("accept on %s error :%s", listener.Addr(), err)
+			}
+
+			return
+		}
+
+		var tlsConn *tls.Conn
+
+		if terminate {
+			tlsConn, _ = conn.(*tls.Conn)
+		}
+
+		if !filter.Allowed(net.ParseIP(remoteIP(conn))) {
+			proxy.W("deny %s connection from %s", side, conn.RemoteAddr())
+			proxy.metrics.denied(side)
+			conn.Close()
+			continue
+		}
+
+		admitted, err := admission.admit(conn)
+
+		if err != nil {
+			proxy.W("refuse connection from %s :%s", conn.RemoteAddr(), err)
+			proxy.metrics.refused(err)
+			conn.Close()
+			continue
+		}
+
+		go proxy.serve(func(name string, conn net.Conn) error {
+			_, err := acceptor.Accept(name, conn)
+			return err
+		}, admitted, tlsConn)
+	}
+}
+
+func (proxy *_Proxy) isClosed() bool {
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	return proxy.closed
+}
+
 func (proxy *_Proxy) Close() {
 
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.drain)
+
+	defer cancel()
+
+	if err := proxy.Shutdown(ctx); err != nil {
+		proxy.W("close proxy %s -- %s", proxy.name, err)
+	}
 }
 
-func (proxy *_Proxy) removeTunnelID(id byte) {
+func (proxy *_Proxy) Shutdown(ctx context.Context) (err error) {
+
+	proxy.closeOnce.Do(func() {
+
+		proxy.Lock()
+
+		proxy.closed = true
+
+		proxy.Unlock()
+
+		proxy.closeListeners()
+
+		err = proxy.drainRequests(ctx)
+
+		proxy.stopSweeper()
+
+		proxy.Lock()
+
+		clients := proxy.clients
+
+		proxy.clients = make(map[string][]*_Client)
+
+		servers := proxy.servers
+
+		proxy.servers = make(map[uint32]Server)
+
+		proxy.Unlock()
+
+		for _, sessions := range clients {
+			for _, client := range sessions {
+				proxy.proxy.RemoveClient(proxy, client)
+				client.Close()
+			}
+		}
+
+		for _, server := range servers {
+			proxy.router.remove(server)
+			proxy.proxy.UnbindServices(proxy, server)
+			server.Close()
+		}
+
+		proxy.proxy.Unregister(proxy)
+
+		if proxy.accessFile != nil {
+			proxy.accessFile.Close()
+		}
+	})
+
+	return
+}
+
+func (proxy *_Proxy) drainRequests(ctx context.Context) error {
+
+	ticker := time.NewTicker(time.Millisecond * 10)
+
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&proxy.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (proxy *_Proxy) failover(device *gorpc.Device, service uint16, from Server, to Server) {
+
+	proxy.W("device(%s) service(%d) failover to new backend", device, service)
+
+	if listener, ok := proxy.proxy.(AffinityListener); ok {
+		listener.Failover(proxy, device, service, from, to)
+	}
+}
+
+func (proxy *_Proxy) addServer(id uint32, server Server, services []*gorpc.NamedService) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.servers[id] = server
+
+	proxy.router.add(server, services)
+}
+
+func (proxy *_Proxy) removeServer(id uint32, server Server) bool {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	if old, ok := proxy.servers[id]; ok && old == server {
+		delete(proxy.servers, id)
+		proxy.router.remove(server)
+		return true
+	}
+
+	return false
+}
+
+func (proxy *_Proxy) removeTunnelID(id uint32, tunnel *_TunnelServerHandler) {
 
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	delete(proxy.tunnels, id)
+	if old, ok := proxy.tunnels[id]; ok && old == tunnel {
+		delete(proxy.tunnels, id)
+	}
 }
 
-func (proxy *_Proxy) tunnelID() byte {
+func (proxy *_Proxy) tunnelID(tunnel *_TunnelServerHandler) (uint32, error) {
 
 	proxy.Lock()
 	defer proxy.Unlock()
 
+	if uint32(len(proxy.tunnels)) >= proxy.maxTunnels {
+		return 0, ErrTunnelID
+	}
+
 	for {
-		proxy.idgen++
+		proxy.idgen = proxy.idgen%proxy.maxTunnels + 1
+
+		if _, ok := proxy.tunnels[proxy.idgen]; !ok {
+			proxy.tunnels[proxy.idgen] = tunnel
+
+			return proxy.idgen, nil
+		}
+	}
+}
 
-		if _, ok := proxy.tunnels[proxy.idgen]; !ok && proxy.idgen != 0 {
-			proxy.tunnels[proxy.idgen] = 0
+func (proxy *_Proxy) detachTunnel(server Server) {
+
+	proxy.RLock()
+	defer proxy.RUnlock()
 
-			return proxy.idgen
+	for _, sessions := range proxy.clients {
+		for _, client := range sessions {
+			client.transproxy().unbindTunnel(server)
 		}
 	}
 }
 
+// client get the newest session of device
 func (proxy *_Proxy) client(device *gorpc.Device) (*_Client, bool) {
 	proxy.RLock()
 	defer proxy.RUnlock()
 
-	client, ok := proxy.clients[device.String()]
+	sessions := proxy.clients[device.String()]
 
-	return client, ok
+	if len(sessions) == 0 {
+		return nil, false
+	}
+
+	return sessions[len(sessions)-1], true
+}
+
+func (proxy *_Proxy) Online(device *gorpc.Device) bool {
+	_, ok := proxy.client(device)
+
+	return ok
 }
 
 func (proxy *_Proxy) addClient(client *_Client) {
 
+	login := proxy.loginClient(client)
+
+	// notify Proxy outside of the lock, so it can call back into proxy
+	if len(login.online) > 0 {
+		if listener, ok := proxy.proxy.(LoginListener); ok {
+			listener.DuplicateLogin(proxy, client, login.online, proxy.login)
+		}
+	}
+
+	for _, session := range login.kicked {
+		proxy.proxy.RemoveClient(proxy, session)
+	}
+
+	if login.added {
+		proxy.proxy.AddClient(proxy, client)
+	}
+
+	// close pipelines outside of the lock, the closed client's Inactive
+	// calls removeClient which is a noop now
+	for _, session := range login.closed {
+		session.Close()
+	}
+}
+
+// _Login registry changes of client login
+type _Login struct {
+	online []Client   // sessions of the device online before login
+	kicked []*_Client // sessions removed from registry
+	closed []*_Client // sessions to close
+	added  bool       // client added to registry
+}
+
+func (proxy *_Proxy) loginClient(client *_Client) *_Login {
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	if client, ok := proxy.clients[client.device.String()]; ok {
+	login := &_Login{}
 
-		proxy.proxy.RemoveClient(proxy, client)
+	if proxy.closed {
+		login.closed = []*_Client{client}
+		return login
+	}
+
+	name := client.device.String()
+
+	sessions := proxy.clients[name]
+
+	if len(sessions) > 0 {
 
-		client.Close()
+		login.online = make([]Client, len(sessions))
+
+		for i, session := range sessions {
+			login.online[i] = session
+		}
+
+		switch proxy.login {
+		case LoginRejectNew:
+			proxy.W("reject duplicate login device(%s)", name)
+			login.closed = []*_Client{client}
+			return login
+		case LoginKickOld:
+			login.kicked = sessions
+			login.closed = sessions
+			sessions = nil
+		}
 	}
 
-	proxy.clients[client.device.String()] = client
+	proxy.clients[name] = append(sessions, client)
+
+	login.added = true
 
-	proxy.proxy.AddClient(proxy, client)
+	return login
 }
 
 func (proxy *_Proxy) removeClient(client *_Client) {
 
+	// notify Proxy outside of the lock, so it can call back into proxy
+	if proxy.unregisterClient(client) {
+		proxy.proxy.RemoveClient(proxy, client)
+	}
+}
+
+// unregisterClient remove client from registry, returns false if the client
+// is not registered
+func (proxy *_Proxy) unregisterClient(client *_Client) bool {
+
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	device := client.device
+	name := client.device.String()
 
-	if old, ok := proxy.clients[device.String()]; ok && client == old {
-		proxy.proxy.RemoveClient(proxy, client)
+	sessions := proxy.clients[name]
+
+	for i, session := range sessions {
+
+		if session != client {
+			continue
+		}
+
+		if len(sessions) == 1 {
+			delete(proxy.clients, name)
+		} else {
+			proxy.clients[name] = append(sessions[:i:i], sessions[i+1:]...)
+		}
+
+		return true
 	}
+
+	return false
 }
@@ -1,9 +1,13 @@
 package gsproxy
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"./gsagent"
+	"github.com/gsdocker/gslogger"
 	"github.com/gsrpc/gorpc"
 )
 
@@ -36,6 +40,78 @@ func (mock *_MockProxy) RemoveClient(context Context, client Client) {
 
 }
 
+type _MockRejectProxy struct {
+	_MockProxy
+}
+
+func (mock *_MockRejectProxy) Register(context Context) error {
+	return errors.New("reject")
+}
+
+type _MockRegistryProxy struct {
+	_MockProxy
+	sync.Mutex
+	added   int
+	removed int
+}
+
+func (mock *_MockRegistryProxy) AddClient(context Context, client Client) error {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.added++
+	return nil
+}
+
+func (mock *_MockRegistryProxy) RemoveClient(context Context, client Client) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.removed++
+}
+
+type _MockPipeline struct {
+	gorpc.Pipeline
+	closed     bool
+	tunnel     *_TunnelServerHandler
+	transproxy *_TransProxyHandler
+	dh         gorpc.Handler
+	auth       gorpc.Handler
+	sent       []*gorpc.Message
+}
+
+func (mock *_MockPipeline) Name() string {
+	return "mock"
+}
+
+func (mock *_MockPipeline) SendMessage(message *gorpc.Message) error {
+	mock.sent = append(mock.sent, message)
+	return nil
+}
+
+func (mock *_MockPipeline) Close() {
+	mock.closed = true
+}
+
+func (mock *_MockPipeline) Handler(name string) (gorpc.Handler, bool) {
+
+	if name == tunnelHandler && mock.tunnel != nil {
+		return mock.tunnel, true
+	}
+
+	if name == transProxyHandler && mock.transproxy != nil {
+		return mock.transproxy, true
+	}
+
+	if name == dhHandler && mock.dh != nil {
+		return mock.dh, true
+	}
+
+	if name == authHandler && mock.auth != nil {
+		return mock.auth, true
+	}
+
+	return nil, false
+}
+
 type _MockAgent struct {
 	Tunnel chan gorpc.Pipeline
 }
@@ -78,11 +154,11 @@ var mockProxy = &_MockProxy{
 
 var agentSystem = gsagent.BuildAgent(mockAgent).Build("gsagent-test")
 
-var gsProxy = BuildProxy(mockProxy).Build("gsproxy-test")
+var gsProxy = BuildProxy(mockProxy).AddrF(":0").AddrB(":0").Build("gsproxy-test")
 
 func TestConnect(t *testing.T) {
 
-	_, err := agentSystem.Connect("gsagent-gsproxy", "localhost:15827")
+	_, err := agentSystem.Connect("gsagent-gsproxy", gsProxy.AddrB().String())
 
 	if err != nil {
 		t.Fatal(err)
@@ -92,3 +168,295 @@ func TestConnect(t *testing.T) {
 
 	<-mockProxy.Services
 }
+
+func TestRegisterReject(t *testing.T) {
+
+	_, err := BuildProxy(&_MockRejectProxy{}).AddrF(":0").AddrB(":0").BuildE("gsproxy-reject")
+
+	if err == nil {
+		t.Fatal("expect register error")
+	}
+}
+
+func TestListenConflict(t *testing.T) {
+
+	_, err := BuildProxy(&_MockProxy{}).AddrF(":0").AddrB(gsProxy.AddrB().String()).BuildE("gsproxy-conflict")
+
+	if err == nil {
+		t.Fatal("expect listen error")
+	}
+}
+
+func TestBuildEUnregister(t *testing.T) {
+
+	mock := &_MockShutdownProxy{}
+
+	context, err := BuildProxy(mock).AddrF(":0").AddrB(gsProxy.AddrB().String()).BuildE("gsproxy-conflict")
+
+	if err == nil || context != nil {
+		t.Fatal("expect listen error without proxy")
+	}
+
+	if mock.unregistered != 1 {
+		t.Fatalf("expect unregister once, got %d", mock.unregistered)
+	}
+}
+
+func TestBuildError(t *testing.T) {
+
+	// Build keeps logging startup errors instead of panicking
+	proxy := BuildProxy(&_MockRejectProxy{}).AddrF(":0").AddrB(":0").Build("gsproxy-reject")
+
+	if proxy == nil || proxy.AddrF() != nil || proxy.AddrB() != nil {
+		t.Fatal("expect not serving proxy")
+	}
+
+	proxy.Close()
+}
+
+func TestTunnelID(t *testing.T) {
+
+	proxy := &_Proxy{
+		tunnels:    make(map[uint32]*_TunnelServerHandler),
+		maxTunnels: 2,
+	}
+
+	first := &_TunnelServerHandler{}
+
+	if _, err := proxy.tunnelID(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proxy.tunnelID(&_TunnelServerHandler{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proxy.tunnelID(&_TunnelServerHandler{}); err != ErrTunnelID {
+		t.Fatalf("expect ErrTunnelID, got %v", err)
+	}
+
+	proxy.removeTunnelID(1, first)
+
+	if id, err := proxy.tunnelID(&_TunnelServerHandler{}); err != nil || id != 1 {
+		t.Fatalf("expect reclaimed id 1, got %d %v", id, err)
+	}
+}
+
+func newRegistryClient(proxy *_Proxy, id string) *_Client {
+
+	device := gorpc.NewDevice()
+
+	device.ID = id
+
+	return &_Client{
+		context:  proxy,
+		device:   device,
+		pipeline: &_MockPipeline{},
+	}
+}
+
+func newRegistryProxy(mock Proxy) *_Proxy {
+	return &_Proxy{
+		Log:     gslogger.Get("gsproxy-test"),
+		proxy:   mock,
+		clients: make(map[string][]*_Client),
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+
+	mock := &_MockRegistryProxy{}
+
+	proxy := newRegistryProxy(mock)
+
+	old := newRegistryClient(proxy, "device")
+
+	proxy.addClient(old)
+
+	current := newRegistryClient(proxy, "device")
+
+	proxy.addClient(current)
+
+	// the kicked client goes inactive after the new one registered
+	proxy.removeClient(old)
+
+	if !proxy.Online(current.device) {
+		t.Fatal("expect device online")
+	}
+
+	if client, _ := proxy.client(current.device); client != current {
+		t.Fatal("expect registry keep the newest client")
+	}
+
+	proxy.removeClient(current)
+
+	if proxy.Online(current.device) {
+		t.Fatal("expect device offline")
+	}
+
+	if mock.added != 2 || mock.removed != 2 {
+		t.Fatalf("expect 2 add/remove callbacks, got %d/%d", mock.added, mock.removed)
+	}
+}
+
+func TestClientReconnectRace(t *testing.T) {
+
+	mock := &_MockRegistryProxy{}
+
+	proxy := newRegistryProxy(mock)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			client := newRegistryClient(proxy, "device")
+
+			proxy.addClient(client)
+
+			proxy.removeClient(client)
+		}()
+	}
+
+	wg.Wait()
+
+	if len(proxy.clients) != 0 {
+		t.Fatalf("expect empty registry, got %d clients", len(proxy.clients))
+	}
+
+	if mock.added != mock.removed {
+		t.Fatalf("expect balanced add/remove callbacks, got %d/%d", mock.added, mock.removed)
+	}
+}
+
+func TestLoginPolicy(t *testing.T) {
+
+	mock := &_MockRegistryProxy{}
+
+	proxy := newRegistryProxy(mock)
+
+	proxy.login = LoginRejectNew
+
+	first := newRegistryClient(proxy, "device")
+
+	proxy.addClient(first)
+
+	proxy.addClient(newRegistryClient(proxy, "device"))
+
+	if client, _ := proxy.client(first.device); client != first {
+		t.Fatal("expect reject the newcomer")
+	}
+
+	proxy.login = LoginAllowMultiple
+
+	second := newRegistryClient(proxy, "device")
+
+	proxy.addClient(second)
+
+	if len(proxy.clients[second.device.String()]) != 2 {
+		t.Fatalf("expect 2 sessions, got %d", len(proxy.clients[second.device.String()]))
+	}
+
+	proxy.removeClient(second)
+
+	if client, _ := proxy.client(first.device); client != first {
+		t.Fatal("expect first session still online")
+	}
+}
+
+type _MockLoginProxy struct {
+	_MockRegistryProxy
+	policy LoginPolicy
+	online int
+	called bool
+}
+
+func (mock *_MockLoginProxy) DuplicateLogin(context Context, client Client, online []Client, policy LoginPolicy) {
+
+	mock.policy = policy
+
+	mock.online = len(online)
+
+	// the listener may call back into proxy
+	mock.called = context.(*_Proxy).Online(client.Device())
+}
+
+func TestLoginListener(t *testing.T) {
+
+	mock := &_MockLoginProxy{}
+
+	proxy := newRegistryProxy(mock)
+
+	proxy.login = LoginKickOld
+
+	old := newRegistryClient(proxy, "device")
+
+	proxy.addClient(old)
+
+	done := make(chan struct{})
+
+	go func() {
+		proxy.addClient(newRegistryClient(proxy, "device"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect login listener called outside of proxy lock")
+	}
+
+	if !mock.called || mock.online != 1 || mock.policy != LoginKickOld {
+		t.Fatal("expect duplicate login reported")
+	}
+
+	if !old.pipeline.(*_MockPipeline).closed {
+		t.Fatal("expect old session kicked")
+	}
+}
+
+type _MockOnlineProxy struct {
+	_MockProxy
+	added   bool
+	removed bool
+}
+
+func (mock *_MockOnlineProxy) AddClient(context Context, client Client) error {
+	mock.added = context.(*_Proxy).Online(client.Device())
+	return nil
+}
+
+func (mock *_MockOnlineProxy) RemoveClient(context Context, client Client) {
+	mock.removed = !context.(*_Proxy).Online(client.Device())
+}
+
+func TestClientCallbackOnline(t *testing.T) {
+
+	mock := &_MockOnlineProxy{}
+
+	proxy := newRegistryProxy(mock)
+
+	client := newRegistryClient(proxy, "device")
+
+	done := make(chan struct{})
+
+	go func() {
+		proxy.addClient(client)
+		proxy.removeClient(client)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect client callbacks called outside of proxy lock")
+	}
+
+	if !mock.added || !mock.removed {
+		t.Fatal("expect callbacks see the registry change")
+	}
+}
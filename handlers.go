@@ -3,28 +3,50 @@ package gsproxy
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/auth"
+	"github.com/gsdocker/gsproxy/trace"
 	"github.com/gsrpc/gorpc"
 	gorpcHandler "github.com/gsrpc/gorpc/handler"
 )
 
 type _TunnelServerHandler struct {
-	gslogger.Log         // mixin log APIs
-	proxy        *_Proxy // proxy
-	id           byte    // agnet id
+	gslogger.Log                             // mixin log APIs
+	sync.Mutex                               // mutex
+	proxy        *_Proxy                     // proxy
+	id           uint32                      // agnet id
+	err          error                       // tunnel id allocate error
+	inflight     int64                       // in-flight requests
+	pending      map[uint16]*_PendingRequest // in-flight requests indexed by proxy request id
+	idgen        uint16                      // proxy request id generator
+	services     []*gorpc.NamedService       // announced services
+	swept        time.Time                   // last pending requests sweep time
+	queue        []*_PendingRequest          // requests waiting for tunnel capacity
+	verified     bool                        // handshake authenticated flag
 }
 
 func (proxy *_Proxy) newTunnelServer() gorpc.Handler {
-	return &_TunnelServerHandler{
-		Log:   gslogger.Get("agent-server-tunnel"),
-		proxy: proxy,
-		id:    proxy.tunnelID(),
+	handler := &_TunnelServerHandler{
+		Log:     gslogger.Get("agent-server-tunnel"),
+		proxy:   proxy,
+		pending: make(map[uint16]*_PendingRequest),
+		swept:   time.Now(),
 	}
+
+	handler.id, handler.err = proxy.tunnelID(handler)
+
+	return handler
 }
 
 func (handler *_TunnelServerHandler) Register(context gorpc.Context) error {
-	return nil
+	if handler.err != nil {
+		handler.E("allocate tunnel id -- failed\n%s", handler.err)
+	}
+
+	return handler.err
 }
 
 func (handler *_TunnelServerHandler) Active(context gorpc.Context) error {
@@ -32,11 +54,57 @@ func (handler *_TunnelServerHandler) Active(context gorpc.Context) error {
 }
 
 func (handler *_TunnelServerHandler) Unregister(context gorpc.Context) {
-
+	handler.proxy.removeTunnelID(handler.id, handler)
 }
 
 func (handler *_TunnelServerHandler) Inactive(context gorpc.Context) {
-	go handler.proxy.proxy.UnbindServices(handler.proxy, context.Pipeline())
+
+	handler.proxy.removeTunnelID(handler.id, handler)
+
+	handler.proxy.detachTunnel(context.Pipeline())
+
+	if handler.proxy.removeServer(handler.id, context.Pipeline()) {
+		go handler.proxy.proxy.UnbindServices(handler.proxy, context.Pipeline())
+	}
+
+	for _, pending := range handler.drainPending() {
+		handler.proxy.failPending(pending)
+	}
+}
+
+// verify authenticate TunnelWhoAmI message if proxy has tunnel verifier,
+// returns the TunnelWhoAmI content without credential
+func (handler *_TunnelServerHandler) verify(message *gorpc.Message) ([]byte, error) {
+
+	verifier := handler.proxy.verifier
+
+	if verifier == nil {
+		return message.Content, nil
+	}
+
+	if message.Agent != auth.MessageFlag {
+		return nil, auth.ErrRequired
+	}
+
+	credential, content, err := auth.Decode(message.Content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifier.Verify(credential, content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// isVerified check if tunnel may forward messages
+func (handler *_TunnelServerHandler) isVerified() bool {
+	handler.Lock()
+	defer handler.Unlock()
+
+	return handler.verified || handler.proxy.verifier == nil
 }
 
 func (handler *_TunnelServerHandler) CloseHandler(context gorpc.Context) {
@@ -49,12 +117,29 @@ func (handler *_TunnelServerHandler) MessageReceived(context gorpc.Context, mess
 
 		handler.I("tunnel handshake ......")
 
-		whoAmI, err := gorpc.ReadTunnelWhoAmI(bytes.NewBuffer(message.Content))
+		content, err := handler.verify(message)
 
 		if err != nil {
+			handler.E("tunnel(%s) handshake authentication -- failed\n%s", context.Name(), err)
+			handler.proxy.metrics.tunnelAuthFailed()
+			context.Close()
 			return nil, err
 		}
 
+		whoAmI, err := gorpc.ReadTunnelWhoAmI(bytes.NewBuffer(content))
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler.Lock()
+		handler.verified = true
+		handler.Unlock()
+
+		handler.services = whoAmI.Services
+
+		handler.proxy.addServer(handler.id, context.Pipeline(), whoAmI.Services)
+
 		handler.proxy.proxy.BindServices(handler.proxy, context.Pipeline(), whoAmI.Services)
 
 		context.FireActive()
@@ -66,8 +151,16 @@ func (handler *_TunnelServerHandler) MessageReceived(context gorpc.Context, mess
 		return message, nil
 	}
 
+	if !handler.isVerified() {
+		handler.E("tunnel(%s) message before authenticated handshake", context.Name())
+		context.Close()
+		return nil, auth.ErrRequired
+	}
+
 	handler.V("backward tunnel message")
 
+	handler.proxy.metrics.tunneled(handler.id, "backward", len(message.Content))
+
 	tunnel, err := gorpc.ReadTunnel(bytes.NewBuffer(message.Content))
 
 	if err != nil {
@@ -75,11 +168,59 @@ func (handler *_TunnelServerHandler) MessageReceived(context gorpc.Context, mess
 		return nil, err
 	}
 
+	if tunnel.Message.Code == gorpc.CodeResponse {
+
+		response, err := gorpc.ReadResponse(bytes.NewBuffer(tunnel.Message.Content))
+
+		if err != nil {
+			handler.E("backward tunnel(%s) response -- failed\n%s", tunnel.ID, err)
+			return nil, nil
+		}
+
+		pending, ok := handler.removePending(response.ID)
+
+		if !ok {
+			handler.E("backward tunnel(%s) response(%d) -- failed,unknown request", tunnel.ID, response.ID)
+			return nil, nil
+		}
+
+		handler.proxy.release(handler)
+
+		handler.proxy.metrics.responded(pending.service, handler.id, time.Since(pending.sent))
+
+		pending.span.Finish(nil)
+
+		handler.proxy.access(pending, OutcomeOK, len(tunnel.Message.Content))
+
+		if err := pending.restore(tunnel.Message); err != nil {
+			handler.E("backward tunnel(%s) response(%d) -- failed\n%s", tunnel.ID, response.ID, err)
+			return nil, nil
+		}
+
+		// answer the session which sent the request
+		if err := pending.handler.pipeline.SendMessage(tunnel.Message); err != nil {
+			handler.E("backward tunnel(%s) response(%d) -- failed\n%s", tunnel.ID, response.ID, err)
+			return nil, nil
+		}
+
+		handler.V("backward tunnel message -- success")
+
+		return nil, nil
+	}
+
 	if device, ok := handler.proxy.client(tunnel.ID); ok {
 
-		tunnel.Message.Agent = handler.id
+		if tunnel.Message.Code == gorpc.CodeRequest {
 
-		err := device.SendMessage(tunnel.Message)
+			err := device.transproxy().correlate(context.Pipeline(), tunnel.Message)
+
+			if err != nil {
+				handler.E("backward tunnel(%s) request -- failed\n%s", tunnel.ID, err)
+				return nil, nil
+			}
+		}
+
+		err = device.SendMessage(tunnel.Message)
 
 		if err == nil {
 			handler.V("backward tunnel message -- success")
@@ -91,6 +232,8 @@ func (handler *_TunnelServerHandler) MessageReceived(context gorpc.Context, mess
 
 	handler.E("backward tunnel(%s) message -- failed,device not found", tunnel.ID)
 
+	handler.proxy.metrics.deviceLost()
+
 	return nil, nil
 }
 
@@ -103,26 +246,50 @@ func (handler *_TunnelServerHandler) Panic(context gorpc.Context, err error) {
 
 }
 
-func (handler *_TunnelServerHandler) ID() byte {
+func (handler *_TunnelServerHandler) ID() uint32 {
 	return handler.id
 }
 
+// InFlight get the number of requests waiting for backend response
+func (handler *_TunnelServerHandler) InFlight() int64 {
+	return atomic.LoadInt64(&handler.inflight)
+}
+
+// tunnelOf get the tunnel handler of backend server
+func tunnelOf(server Server) (*_TunnelServerHandler, bool) {
+
+	handler, ok := server.Handler(tunnelHandler)
+
+	if !ok {
+		return nil, false
+	}
+
+	tunnel, ok := handler.(*_TunnelServerHandler)
+
+	return tunnel, ok
+}
+
 type _TransProxyHandler struct {
-	gslogger.Log                   // mixin log APIs
-	sync.RWMutex                   // mixin rw locker
-	proxy        *_Proxy           // proxy
-	client       *_Client          // client
-	device       *gorpc.Device     // devices
-	servers      map[uint16]Server // bound servers
-	tunnels      map[byte]Server   // bound servers
+	gslogger.Log                          // mixin log APIs
+	sync.RWMutex                          // mixin rw locker
+	proxy        *_Proxy                  // proxy
+	client       *_Client                 // client
+	device       *gorpc.Device            // devices
+	pipeline     gorpc.Pipeline           // client pipeline
+	servers      map[uint16]Server        // bound servers
+	correlations map[uint16]*_Correlation // backend requests indexed by proxy request id
+	idgen        uint16                   // proxy request id gen
+	swept        time.Time                // last correlations sweep time
+	acl          map[uint16]bool          // services client may call, nil allows all
 }
 
 func (proxy *_Proxy) newTransProxyHandler() gorpc.Handler {
 	return &_TransProxyHandler{
-		Log:     gslogger.Get("trans-proxy"),
-		proxy:   proxy,
-		servers: make(map[uint16]Server),
-		tunnels: make(map[byte]Server),
+		Log:          gslogger.Get("trans-proxy"),
+		proxy:        proxy,
+		servers:      make(map[uint16]Server),
+		correlations: make(map[uint16]*_Correlation),
+		swept:        time.Now(),
 	}
 }
 
@@ -130,11 +297,25 @@ func (handler *_TransProxyHandler) bind(id uint16, server Server) {
 	handler.Lock()
 	defer handler.Unlock()
 
-	tunnel, _ := server.Handler(tunnelHandler)
-
 	handler.servers[id] = server
+}
 
-	handler.tunnels[tunnel.(*_TunnelServerHandler).ID()] = server
+// unbindTunnel remove all bindings and correlations to closed tunnel
+func (handler *_TransProxyHandler) unbindTunnel(server Server) {
+	handler.Lock()
+	defer handler.Unlock()
+
+	for local, correlation := range handler.correlations {
+		if correlation.server == server {
+			delete(handler.correlations, local)
+		}
+	}
+
+	for service, target := range handler.servers {
+		if target == server {
+			delete(handler.servers, service)
+		}
+	}
 }
 
 func (handler *_TransProxyHandler) unbind(id uint16) {
@@ -154,6 +335,8 @@ func (handler *_TransProxyHandler) Active(context gorpc.Context) error {
 
 	handler.device = dh.(gorpcHandler.CryptoServer).GetDevice()
 
+	handler.pipeline = context.Pipeline()
+
 	return nil
 }
 
@@ -165,7 +348,7 @@ func (handler *_TransProxyHandler) Inactive(context gorpc.Context) {
 
 }
 
-func (handler *_TransProxyHandler) forward(server Server, message *gorpc.Message) error {
+func (handler *_TransProxyHandler) forward(server Server, message *gorpc.Message, span *trace.Span) error {
 	handler.V("forward tunnel(%s) message", handler.device)
 
 	tunnel := gorpc.NewTunnel()
@@ -186,9 +369,20 @@ func (handler *_TransProxyHandler) forward(server Server, message *gorpc.Message
 
 	message.Content = buff.Bytes()
 
+	message.Agent = 0
+
+	if span != nil {
+		message.Agent = trace.MessageFlag
+		message.Content = trace.Encode(span.SpanContext(), message.Content)
+	}
+
 	err = server.SendMessage(message)
 
 	if err == nil {
+		if tunnel, ok := tunnelOf(server); ok {
+			handler.proxy.metrics.tunneled(tunnel.ID(), "forward", len(message.Content))
+		}
+
 		handler.V("forward tunnel(%s) message(%p) -- success", handler.device, message)
 	} else {
 		handler.E("forward tunnel(%s) message -- failed\n%s", handler.device, err)
@@ -197,43 +391,119 @@ func (handler *_TransProxyHandler) forward(server Server, message *gorpc.Message
 	return err
 }
 
-func (handler *_TransProxyHandler) tunnel(agent byte) (Server, bool) {
+// forwardRequest forward client request to backend server and track it until
+// the backend responds
+func (handler *_TransProxyHandler) forwardRequest(server Server, message *gorpc.Message, request *gorpc.Request, parent trace.SpanContext) error {
 
-	handler.RLock()
-	defer handler.RUnlock()
+	service := request.Service
+
+	span := trace.Start(handler.proxy.tracer, "gsproxy.forward", parent)
+
+	span.Set("device", handler.device)
+
+	span.Set("service", service)
+
+	pending := &_PendingRequest{
+		handler: handler,
+		id:      request.ID,
+		service: service,
+		method:  request.Method,
+		content: message.Content,
+		sent:    time.Now(),
+		server:  server,
+		parent:  parent,
+		span:    span,
+	}
+
+	tunnel, ok := tunnelOf(server)
+
+	if ok {
+		pending.tunnel = tunnel.ID()
+
+		span.Set("tunnel", tunnel.ID())
+
+		admitted, err := tunnel.admit(pending)
+
+		if err != nil {
+			handler.W("[%s] request(%d) of service(%d) rejected, tunnel(%d) -- %s", handler.device, request.ID, service, tunnel.ID(), err)
+
+			handler.proxy.access(pending, OutcomeOverloaded, 0)
 
-	server, ok := handler.tunnels[agent]
+			span.Finish(err)
 
-	return server, ok
+			return err
+		}
+
+		if !admitted {
+			tunnel.pump()
+			return nil
+		}
+	}
+
+	return handler.dispatch(pending)
 }
 
+// dispatch forward tracked request to its backend
+func (handler *_TransProxyHandler) dispatch(pending *_PendingRequest) error {
+
+	err := handler.forward(pending.server, pending.message(), pending.span)
+
+	if err != nil {
+		handler.proxy.metrics.forwardFailed(pending.service)
+
+		handler.proxy.access(pending, OutcomeForwardFailed, 0)
+
+		pending.span.Finish(err)
+
+		if tunnel, ok := tunnelOf(pending.server); ok {
+			if _, ok := tunnel.removePending(pending.local); ok {
+				handler.proxy.release(tunnel)
+			}
+		}
+
+		return err
+	}
+
+	handler.proxy.metrics.forwarded(pending.service, len(pending.content))
+
+	return nil
+}
+
+// transproxy get the backend server of service, the per-client binding
+// overrides the proxy service table
 func (handler *_TransProxyHandler) transproxy(service uint16) (Server, bool) {
 
 	handler.RLock()
-	defer handler.RUnlock()
 
 	server, ok := handler.servers[service]
 
-	return server, ok
+	handler.RUnlock()
+
+	if ok {
+		return server, ok
+	}
+
+	return handler.proxy.router.route(service, handler.device)
 }
 
 func (handler *_TransProxyHandler) MessageReceived(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
 
 	if message.Code == gorpc.CodeResponse {
 
-		if server, ok := handler.tunnel(message.Agent); ok {
+		server, err := handler.respond(message)
 
-			err := handler.forward(server, message)
+		if err != nil {
+			handler.E("forward tunnel(%s) response -- failed\n%s", handler.device, err)
+			return nil, nil
+		}
 
-			if err != nil {
-				context.Close()
-			}
+		err = handler.forward(server, message, nil)
 
-			return nil, err
+		if err != nil {
+			context.Close()
 		}
 
-		return message, nil
-
+		return nil, err
 	}
 
 	if message.Code != gorpc.CodeRequest {
@@ -241,6 +511,28 @@ func (handler *_TransProxyHandler) MessageReceived(context gorpc.Context, messag
 		return message, nil
 	}
 
+	var parent trace.SpanContext
+
+	if message.Agent == trace.MessageFlag {
+
+		decoded, content, err := trace.Decode(message.Content)
+
+		if content == nil {
+			handler.E("[%s] unmarshal request trace context error\n%s", handler.proxy.name, err)
+			return nil, err
+		}
+
+		if err != nil {
+			handler.W("[%s] ignore request trace context\n%s", handler.proxy.name, err)
+		}
+
+		parent = decoded
+
+		message.Agent = 0
+
+		message.Content = content
+	}
+
 	request, err := gorpc.ReadRequest(bytes.NewBuffer(message.Content))
 
 	if err != nil {
@@ -252,40 +544,50 @@ func (handler *_TransProxyHandler) MessageReceived(context gorpc.Context, messag
 
 	if transproxy, ok := handler.transproxy(service); ok {
 
-		handler.V("forward tunnel(%s) message", handler.device)
-
-		tunnel := gorpc.NewTunnel()
-
-		tunnel.ID = handler.device
+		// the acl only guards backend services, proxy local services such as
+		// login stay reachable
+		if !handler.allowed(service) {
+			handler.W("[%s] tunnel(%s) request(%d) of service(%d) forbidden", handler.proxy.name, handler.device, request.ID, service)
+			handler.proxy.metrics.forbidden(service)
+			return nil, handler.answer(context, request, ExceptionForbidden)
+		}
 
-		tunnel.Message = message
+		if handler.proxy.isClosed() {
+			handler.W("reject tunnel(%s) request -- %s", handler.device, ErrClosed)
+			return nil, handler.answer(context, request, ExceptionClosed)
+		}
 
-		var buff bytes.Buffer
+		err := handler.forwardRequest(transproxy, message, request, parent)
 
-		err := gorpc.WriteTunnel(&buff, tunnel)
+		if err == ErrOverloaded {
+			return nil, handler.answer(context, request, ExceptionOverloaded)
+		}
 
 		if err != nil {
+			context.Close()
 			return nil, err
 		}
 
-		message.Code = gorpc.CodeTunnel
+		return nil, nil
+	}
 
-		message.Content = buff.Bytes()
+	return message, nil
+}
 
-		err = transproxy.SendMessage(message)
+// answer answer client request with proxy exception without forwarding it
+func (handler *_TransProxyHandler) answer(context gorpc.Context, request *gorpc.Request, exception int8) error {
 
-		if err != nil {
-			context.Close()
-			handler.V("forward tunnel(%s) message(%p) -- failed\n%s", handler.device, message, err)
-			return nil, err
-		}
+	response, err := newErrorResponse(request.ID, request.Service, exception)
 
-		handler.V("forward tunnel(%s) message(%p) -- success", handler.device, message)
+	if err != nil {
+		return err
+	}
 
-		return nil, err
+	if err := context.Pipeline().SendMessage(response); err != nil {
+		handler.E("[%s] answer request(%d) with exception(%d) error\n%s", handler.proxy.name, request.ID, exception, err)
 	}
 
-	return message, nil
+	return nil
 }
 
 func (handler *_TransProxyHandler) MessageSending(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
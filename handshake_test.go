@@ -0,0 +1,70 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gsdocker/gsproxy/auth"
+	"github.com/gsrpc/gorpc"
+)
+
+func newWhoAmIMessage(signer auth.Signer) *gorpc.Message {
+
+	var buff bytes.Buffer
+
+	gorpc.WriteTunnelWhoAmI(&buff, gorpc.NewTunnelWhoAmI())
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeTunnelWhoAmI
+
+	message.Content = buff.Bytes()
+
+	if signer != nil {
+		credential, _ := signer.Sign(message.Content)
+
+		message.Content, _ = auth.Encode(credential, message.Content)
+
+		message.Agent = auth.MessageFlag
+	}
+
+	return message
+}
+
+func TestTunnelHandshakeAuth(t *testing.T) {
+
+	proxy, _, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	proxy.verifier = auth.NewHMAC([]byte("secret"), time.Minute)
+
+	tunnel := servers[0].tunnel
+
+	if _, err := tunnel.verify(newWhoAmIMessage(auth.NewHMAC([]byte("secret"), 0))); err != nil {
+		t.Fatal(err)
+	}
+
+	context := &_MockNamedContext{_MockContext: _MockContext{pipeline: servers[0]}}
+
+	if _, err := tunnel.MessageReceived(context, newWhoAmIMessage(nil)); err != auth.ErrRequired || !context.closed {
+		t.Fatal("expect unsigned handshake rejected")
+	}
+
+	context.closed = false
+
+	if _, err := tunnel.MessageReceived(context, newWhoAmIMessage(auth.NewHMAC([]byte("other"), 0))); err != auth.ErrCredential || !context.closed {
+		t.Fatal("expect wrong secret rejected")
+	}
+
+	if proxy.metrics.tunnelAuthFailures.Get() != 2 {
+		t.Fatal("expect two authentication failures")
+	}
+
+	context.closed = false
+
+	if _, err := tunnel.MessageReceived(context, newTunnelResponse(gorpc.NewDevice(), 1)); err != auth.ErrRequired || !context.closed {
+		t.Fatal("expect tunnel message before handshake rejected")
+	}
+}
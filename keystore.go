@@ -0,0 +1,240 @@
+package gsproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+
+	"github.com/gsrpc/gorpc"
+	"github.com/gsrpc/gorpc/handler"
+)
+
+// Errors of the dh key store
+var (
+	// ErrDHKeyNotFound key id not found in key store
+	ErrDHKeyNotFound = errors.New("gsproxy dh key not found")
+)
+
+// DHGroup dh parameters in key store file, numbers are parsed with base prefix
+type DHGroup struct {
+	G string `json:"g"` // generator
+	P string `json:"p"` // prime
+}
+
+// DHKeyStoreFile key store file layout:
+//
+//	{
+//		"default": "2024-02",
+//		"keys":    {"2024-01": {"g": "...", "p": "..."}, "2024-02": {...}},
+//		"types":   {"android": "2024-01"},
+//		"devices": {"device-id": "2024-01"}
+//	}
+//
+// devices and types pin key ids, other devices use the default key id
+type DHKeyStoreFile struct {
+	Default string             `json:"default"` // default key id
+	Keys    map[string]DHGroup `json:"keys"`    // dh groups indexed by key id
+	Types   map[string]string  `json:"types"`   // key id per device type
+	Devices map[string]string  `json:"devices"` // key id per device id
+}
+
+type _DHParams struct {
+	G *big.Int // generator
+	P *big.Int // prime
+}
+
+// DHKeyStore handler.DHKeyResolver resolves dh parameters by device id, then
+// device type, then the default key id. Keys can be added at runtime or
+// reloaded from the key store file without restart
+type DHKeyStore struct {
+	sync.RWMutex                       // mutex
+	path         string                // key store file path
+	defaultID    string                // default key id
+	keys         map[string]*_DHParams // dh params indexed by key id
+	types        map[string]string     // key id per device type
+	devices      map[string]string     // key id per device id
+}
+
+// NewDHKeyStore load key store file
+func NewDHKeyStore(path string) (*DHKeyStore, error) {
+
+	store := &DHKeyStore{
+		path: path,
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Reload reload key store file, the store is unchanged on error
+func (store *DHKeyStore) Reload() error {
+
+	content, err := ioutil.ReadFile(store.path)
+
+	if err != nil {
+		return err
+	}
+
+	var file DHKeyStoreFile
+
+	if err := json.Unmarshal(content, &file); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*_DHParams)
+
+	for id, group := range file.Keys {
+
+		params, err := parseDHGroup(group)
+
+		if err != nil {
+			return fmt.Errorf("dh key %s :%s", id, err)
+		}
+
+		keys[id] = params
+	}
+
+	if _, ok := keys[file.Default]; !ok {
+		return fmt.Errorf("default dh key %s :%s", file.Default, ErrDHKeyNotFound)
+	}
+
+	for _, pins := range []map[string]string{file.Types, file.Devices} {
+		for name, id := range pins {
+			if _, ok := keys[id]; !ok {
+				return fmt.Errorf("dh key %s of %s :%s", id, name, ErrDHKeyNotFound)
+			}
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	store.defaultID = file.Default
+
+	store.keys = keys
+
+	store.types = copyPins(file.Types)
+
+	store.devices = copyPins(file.Devices)
+
+	return nil
+}
+
+func copyPins(pins map[string]string) map[string]string {
+
+	copied := make(map[string]string, len(pins))
+
+	for name, id := range pins {
+		copied[name] = id
+	}
+
+	return copied
+}
+
+func parseDHGroup(group DHGroup) (*_DHParams, error) {
+
+	G, ok := new(big.Int).SetString(group.G, 0)
+
+	if !ok {
+		return nil, fmt.Errorf("invalid g %s", group.G)
+	}
+
+	P, ok := new(big.Int).SetString(group.P, 0)
+
+	if !ok {
+		return nil, fmt.Errorf("invalid p %s", group.P)
+	}
+
+	return &_DHParams{G: G, P: P}, nil
+}
+
+// Add add or replace dh group at runtime
+func (store *DHKeyStore) Add(id string, G *big.Int, P *big.Int) {
+	store.Lock()
+	defer store.Unlock()
+
+	store.keys[id] = &_DHParams{G: G, P: P}
+}
+
+// SetDefault switch the default key id
+func (store *DHKeyStore) SetDefault(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.keys[id]; !ok {
+		return ErrDHKeyNotFound
+	}
+
+	store.defaultID = id
+
+	return nil
+}
+
+// PinDevice use key id for device
+func (store *DHKeyStore) PinDevice(device string, id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.keys[id]; !ok {
+		return ErrDHKeyNotFound
+	}
+
+	store.devices[device] = id
+
+	return nil
+}
+
+// PinType use key id for device type
+func (store *DHKeyStore) PinType(deviceType string, id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.keys[id]; !ok {
+		return ErrDHKeyNotFound
+	}
+
+	store.types[deviceType] = id
+
+	return nil
+}
+
+// KeyID get key id used by device
+func (store *DHKeyStore) KeyID(device *gorpc.Device) string {
+	store.RLock()
+	defer store.RUnlock()
+
+	return store.keyID(device)
+}
+
+func (store *DHKeyStore) keyID(device *gorpc.Device) string {
+
+	if id, ok := store.devices[device.ID]; ok {
+		return id
+	}
+
+	if id, ok := store.types[device.Type]; ok {
+		return id
+	}
+
+	return store.defaultID
+}
+
+// Resolve implement handler.DHKeyResolver
+func (store *DHKeyStore) Resolve(device *gorpc.Device) (*handler.DHKey, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	params, ok := store.keys[store.keyID(device)]
+
+	if !ok {
+		return nil, ErrDHKeyNotFound
+	}
+
+	return handler.NewDHKey(params.G, params.P), nil
+}
@@ -0,0 +1,97 @@
+package gsproxy
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gsrpc/gorpc"
+)
+
+const testKeyStore = `{
+	"default": "v2",
+	"keys": {
+		"v1": {"g": "5", "p": "23"},
+		"v2": {"g": "0x2", "p": "0x17"}
+	},
+	"types": {"android": "v1"},
+	"devices": {"pinned": "v1"}
+}`
+
+func newKeyStoreDevice(id string, deviceType string) *gorpc.Device {
+
+	device := gorpc.NewDevice()
+
+	device.ID = id
+
+	device.Type = deviceType
+
+	return device
+}
+
+func TestDHKeyStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "gsproxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dhkeys.json")
+
+	ioutil.WriteFile(path, []byte(testKeyStore), 0600)
+
+	store, err := NewDHKeyStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.KeyID(newKeyStoreDevice("pinned", "ios")) != "v1" ||
+		store.KeyID(newKeyStoreDevice("other", "android")) != "v1" ||
+		store.KeyID(newKeyStoreDevice("other", "ios")) != "v2" {
+		t.Fatal("unexpect key id resolution")
+	}
+
+	store.Add("v3", big.NewInt(2), big.NewInt(11))
+
+	if err := store.SetDefault("v3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.KeyID(newKeyStoreDevice("other", "ios")) != "v3" {
+		t.Fatal("expect rotated default key")
+	}
+
+	if err := store.PinDevice("other", "v4"); err != ErrDHKeyNotFound {
+		t.Fatal("expect unknown key rejected")
+	}
+
+	if _, err := store.Resolve(newKeyStoreDevice("other", "ios")); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"default": "v9", "keys": {}}`), 0600)
+
+	if err := store.Reload(); err == nil {
+		t.Fatal("expect missing default key error")
+	}
+
+	if store.KeyID(newKeyStoreDevice("other", "ios")) != "v3" {
+		t.Fatal("expect store unchanged on reload error")
+	}
+
+	ioutil.WriteFile(path, []byte(testKeyStore), 0600)
+
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.KeyID(newKeyStoreDevice("other", "ios")) != "v2" {
+		t.Fatal("expect reloaded default key")
+	}
+}
@@ -0,0 +1,265 @@
+package gsproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gsdocker/gsproxy/metrics"
+)
+
+// Latency request latency statistics of a service or a backend tunnel
+type Latency struct {
+	metrics.HistogramSnapshot        // response latency in seconds
+	Timeouts                  uint64 // requests not answered within rpc timeout
+}
+
+// _Metrics proxy metrics, nil metrics ignores all updates
+type _Metrics struct {
+	registry           *metrics.Registry  // registry
+	forwardMessages    *metrics.Counter   // requests forwarded per service
+	forwardBytes       *metrics.Counter   // request bytes forwarded per service
+	forwardFailures    *metrics.Counter   // requests failed to forward per service
+	tunnelMessages     *metrics.Counter   // messages per tunnel and direction
+	tunnelBytes        *metrics.Counter   // bytes per tunnel and direction
+	deviceNotFound     *metrics.Counter   // backward messages dropped for offline device
+	handshakeFailures  *metrics.Counter   // frontend connections closed before handshake
+	serviceLatency     *metrics.Histogram // response latency per service
+	tunnelLatency      *metrics.Histogram // response latency per tunnel
+	serviceTimeouts    *metrics.Counter   // timeout requests per service
+	tunnelTimeouts     *metrics.Counter   // timeout requests per tunnel
+	rateLimits         *metrics.Counter   // requests rejected by rate limit per service
+	overloads          *metrics.Counter   // requests rejected by saturated tunnel
+	queueDepth         *metrics.Gauge     // requests waiting for tunnel capacity
+	forbiddens         *metrics.Counter   // requests rejected by service acl per service
+	authRejects        *metrics.Counter   // devices rejected by authenticator per reason code
+	refusedConns       *metrics.Counter   // frontend connections refused by admission control
+	deniedConns        *metrics.Counter   // connections denied by peer filter per listener
+	tunnelAuthFailures *metrics.Counter   // backend tunnel handshakes failed authentication
+}
+
+func (proxy *_Proxy) newMetrics() *_Metrics {
+
+	registry := metrics.New()
+
+	registry.GaugeFunc("gsproxy_clients", "connected client sessions", func() float64 {
+		proxy.RLock()
+		defer proxy.RUnlock()
+
+		var count int
+
+		for _, sessions := range proxy.clients {
+			count += len(sessions)
+		}
+
+		return float64(count)
+	})
+
+	registry.GaugeFunc("gsproxy_tunnels", "handshaked backend tunnels", func() float64 {
+		proxy.RLock()
+		defer proxy.RUnlock()
+
+		return float64(len(proxy.servers))
+	})
+
+	return &_Metrics{
+		registry:           registry,
+		forwardMessages:    registry.Counter("gsproxy_forward_messages_total", "requests forwarded to backend", "service"),
+		forwardBytes:       registry.Counter("gsproxy_forward_bytes_total", "request bytes forwarded to backend", "service"),
+		forwardFailures:    registry.Counter("gsproxy_forward_failures_total", "requests failed to forward to backend", "service"),
+		tunnelMessages:     registry.Counter("gsproxy_tunnel_messages_total", "messages through backend tunnel", "tunnel", "direction"),
+		tunnelBytes:        registry.Counter("gsproxy_tunnel_bytes_total", "bytes through backend tunnel", "tunnel", "direction"),
+		deviceNotFound:     registry.Counter("gsproxy_device_not_found_total", "backward messages dropped because device is offline"),
+		handshakeFailures:  registry.Counter("gsproxy_handshake_failures_total", "frontend connections closed before dh or tls handshake completed"),
+		serviceLatency:     registry.Histogram("gsproxy_service_latency_seconds", "backend response latency per service", metrics.DefBuckets, "service"),
+		tunnelLatency:      registry.Histogram("gsproxy_tunnel_latency_seconds", "backend response latency per tunnel", metrics.DefBuckets, "tunnel"),
+		serviceTimeouts:    registry.Counter("gsproxy_service_timeouts_total", "requests not answered within rpc timeout per service", "service"),
+		tunnelTimeouts:     registry.Counter("gsproxy_tunnel_timeouts_total", "requests not answered within rpc timeout per tunnel", "tunnel"),
+		rateLimits:         registry.Counter("gsproxy_rate_limited_total", "requests rejected by rate limit per service", "service"),
+		overloads:          registry.Counter("gsproxy_overloaded_total", "requests rejected because backend tunnel is saturated", "tunnel"),
+		deniedConns:        registry.Counter("gsproxy_denied_connections_total", "connections denied by peer ip filter", "listener"),
+		tunnelAuthFailures: registry.Counter("gsproxy_tunnel_auth_failures_total", "backend tunnel handshakes failed authentication"),
+		forbiddens:         registry.Counter("gsproxy_forbidden_total", "requests rejected by client service acl", "service"),
+		authRejects:        registry.Counter("gsproxy_auth_rejected_total", "devices rejected by authenticator", "code"),
+		refusedConns:       registry.Counter("gsproxy_refused_connections_total", "frontend connections refused before dh handshake", "reason"),
+		queueDepth:         registry.Gauge("gsproxy_tunnel_queue_depth", "requests waiting for backend tunnel capacity", "tunnel"),
+	}
+}
+
+func (proxy *_Proxy) Metrics() *metrics.Registry {
+	if proxy.metrics == nil {
+		return nil
+	}
+
+	return proxy.metrics.registry
+}
+
+func (proxy *_Proxy) ServiceLatency(service uint16) Latency {
+	if proxy.metrics == nil {
+		return Latency{}
+	}
+
+	label := fmt.Sprintf("%d", service)
+
+	return Latency{
+		HistogramSnapshot: proxy.metrics.serviceLatency.Snapshot(label),
+		Timeouts:          uint64(proxy.metrics.serviceTimeouts.Get(label)),
+	}
+}
+
+func (proxy *_Proxy) TunnelLatency(tunnel uint32) Latency {
+	if proxy.metrics == nil {
+		return Latency{}
+	}
+
+	label := fmt.Sprintf("%d", tunnel)
+
+	return Latency{
+		HistogramSnapshot: proxy.metrics.tunnelLatency.Snapshot(label),
+		Timeouts:          uint64(proxy.metrics.tunnelTimeouts.Get(label)),
+	}
+}
+
+func (m *_Metrics) responded(service uint16, tunnel uint32, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.serviceLatency.Observe(latency.Seconds(), fmt.Sprintf("%d", service))
+
+	m.tunnelLatency.Observe(latency.Seconds(), fmt.Sprintf("%d", tunnel))
+}
+
+func (m *_Metrics) timedOut(service uint16, tunnel uint32) {
+	if m == nil {
+		return
+	}
+
+	m.serviceTimeouts.Inc(fmt.Sprintf("%d", service))
+
+	m.tunnelTimeouts.Inc(fmt.Sprintf("%d", tunnel))
+}
+
+func (m *_Metrics) forwarded(service uint16, size int) {
+	if m == nil {
+		return
+	}
+
+	label := fmt.Sprintf("%d", service)
+
+	m.forwardMessages.Inc(label)
+
+	m.forwardBytes.Add(float64(size), label)
+}
+
+func (m *_Metrics) forwardFailed(service uint16) {
+	if m == nil {
+		return
+	}
+
+	m.forwardFailures.Inc(fmt.Sprintf("%d", service))
+}
+
+func (m *_Metrics) tunneled(tunnel uint32, direction string, size int) {
+	if m == nil {
+		return
+	}
+
+	label := fmt.Sprintf("%d", tunnel)
+
+	m.tunnelMessages.Inc(label, direction)
+
+	m.tunnelBytes.Add(float64(size), label, direction)
+}
+
+func (m *_Metrics) deviceLost() {
+	if m == nil {
+		return
+	}
+
+	m.deviceNotFound.Inc()
+}
+
+func (m *_Metrics) handshakeFailed() {
+	if m == nil {
+		return
+	}
+
+	m.handshakeFailures.Inc()
+}
+
+func (m *_Metrics) rateLimited(service uint16) {
+	if m == nil {
+		return
+	}
+
+	m.rateLimits.Inc(fmt.Sprintf("%d", service))
+}
+
+func (m *_Metrics) overloaded(tunnel uint32) {
+	if m == nil {
+		return
+	}
+
+	m.overloads.Inc(fmt.Sprintf("%d", tunnel))
+}
+
+func (m *_Metrics) queued(tunnel uint32, depth int) {
+	if m == nil {
+		return
+	}
+
+	m.queueDepth.Set(float64(depth), fmt.Sprintf("%d", tunnel))
+}
+
+func (m *_Metrics) refused(err error) {
+	if m == nil {
+		return
+	}
+
+	var reason string
+
+	switch err {
+	case ErrMaxConns:
+		reason = "max_conns"
+	case ErrMaxConnsPerIP:
+		reason = "max_conns_per_ip"
+	case ErrHandshakeRate:
+		reason = "handshake_rate"
+	default:
+		reason = "other"
+	}
+
+	m.refusedConns.Inc(reason)
+}
+
+func (m *_Metrics) denied(side string) {
+	if m == nil {
+		return
+	}
+
+	m.deniedConns.Inc(side)
+}
+
+func (m *_Metrics) tunnelAuthFailed() {
+	if m == nil {
+		return
+	}
+
+	m.tunnelAuthFailures.Inc()
+}
+
+func (m *_Metrics) authRejected(code byte) {
+	if m == nil {
+		return
+	}
+
+	m.authRejects.Inc(fmt.Sprintf("%d", code))
+}
+
+func (m *_Metrics) forbidden(service uint16) {
+	if m == nil {
+		return
+	}
+
+	m.forbiddens.Inc(fmt.Sprintf("%d", service))
+}
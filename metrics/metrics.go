@@ -0,0 +1,431 @@
+// Package metrics minimal metrics registry exported in prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry metrics registry
+type Registry struct {
+	sync.RWMutex                    // mutex
+	families     map[string]_Family // registered metrics
+}
+
+// New create metrics registry
+func New() *Registry {
+	return &Registry{
+		families: make(map[string]_Family),
+	}
+}
+
+type _Family interface {
+	write(w io.Writer)
+}
+
+func (registry *Registry) register(name string, family _Family) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.families[name]; ok {
+		panic(fmt.Sprintf("metrics %s already registered", name))
+	}
+
+	registry.families[name] = family
+}
+
+// WriteTo write all metrics in prometheus text format
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	registry.RLock()
+
+	names := make([]string, 0, len(registry.families))
+
+	for name := range registry.families {
+		names = append(names, name)
+	}
+
+	registry.RUnlock()
+
+	sort.Strings(names)
+
+	var buff bytes.Buffer
+
+	for _, name := range names {
+
+		registry.RLock()
+
+		family := registry.families[name]
+
+		registry.RUnlock()
+
+		family.write(&buff)
+	}
+
+	return buff.WriteTo(w)
+}
+
+// ServeHTTP implement http.Handler
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registry.WriteTo(w)
+}
+
+// _Vec samples indexed by label values
+type _Vec struct {
+	sync.Mutex                     // mutex
+	name       string              // metrics name
+	help       string              // help text
+	kind       string              // metrics type
+	labels     []string            // label names
+	samples    map[string]*float64 // samples indexed by encoded label values
+}
+
+func newVec(name, help, kind string, labels []string) *_Vec {
+	return &_Vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*float64),
+	}
+}
+
+func (vec *_Vec) add(delta float64, values []string) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	key := vec.key(values)
+
+	sample, ok := vec.samples[key]
+
+	if !ok {
+		sample = new(float64)
+		vec.samples[key] = sample
+	}
+
+	*sample += delta
+}
+
+func (vec *_Vec) set(val float64, values []string) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	key := vec.key(values)
+
+	sample, ok := vec.samples[key]
+
+	if !ok {
+		sample = new(float64)
+		vec.samples[key] = sample
+	}
+
+	*sample = val
+}
+
+func (vec *_Vec) get(values []string) float64 {
+	vec.Lock()
+	defer vec.Unlock()
+
+	if sample, ok := vec.samples[vec.key(values)]; ok {
+		return *sample
+	}
+
+	return 0
+}
+
+func (vec *_Vec) key(values []string) string {
+
+	if len(values) != len(vec.labels) {
+		panic(fmt.Sprintf("metrics %s expect %d label values, got %d", vec.name, len(vec.labels), len(values)))
+	}
+
+	return encodeLabels(vec.labels, values)
+}
+
+func (vec *_Vec) write(w io.Writer) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	writeHeader(w, vec.name, vec.help, vec.kind)
+
+	keys := make([]string, 0, len(vec.samples))
+
+	for key := range vec.samples {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", vec.name, key, formatFloat(*vec.samples[key]))
+	}
+}
+
+// Counter monotonically increasing metrics, nil counter ignores all updates
+type Counter struct {
+	vec *_Vec
+}
+
+// Counter register counter with label names
+func (registry *Registry) Counter(name, help string, labels ...string) *Counter {
+
+	counter := &Counter{vec: newVec(name, help, "counter", labels)}
+
+	registry.register(name, counter.vec)
+
+	return counter
+}
+
+// Inc increase counter of label values by 1
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+// Add increase counter of label values by delta
+func (counter *Counter) Add(delta float64, values ...string) {
+	if counter != nil {
+		counter.vec.add(delta, values)
+	}
+}
+
+// Get get counter of label values
+func (counter *Counter) Get(values ...string) float64 {
+	if counter == nil {
+		return 0
+	}
+
+	return counter.vec.get(values)
+}
+
+// Gauge metrics can go up and down, nil gauge ignores all updates
+type Gauge struct {
+	vec *_Vec
+}
+
+// Gauge register gauge with label names
+func (registry *Registry) Gauge(name, help string, labels ...string) *Gauge {
+
+	gauge := &Gauge{vec: newVec(name, help, "gauge", labels)}
+
+	registry.register(name, gauge.vec)
+
+	return gauge
+}
+
+// Set set gauge of label values
+func (gauge *Gauge) Set(val float64, values ...string) {
+	if gauge != nil {
+		gauge.vec.set(val, values)
+	}
+}
+
+// Add add delta to gauge of label values
+func (gauge *Gauge) Add(delta float64, values ...string) {
+	if gauge != nil {
+		gauge.vec.add(delta, values)
+	}
+}
+
+// Get get gauge of label values
+func (gauge *Gauge) Get(values ...string) float64 {
+	if gauge == nil {
+		return 0
+	}
+
+	return gauge.vec.get(values)
+}
+
+type _GaugeFunc struct {
+	name string         // metrics name
+	help string         // help text
+	f    func() float64 // sample function
+}
+
+// GaugeFunc register gauge sampled by f on every export
+func (registry *Registry) GaugeFunc(name, help string, f func() float64) {
+	registry.register(name, &_GaugeFunc{name: name, help: help, f: f})
+}
+
+func (gauge *_GaugeFunc) write(w io.Writer) {
+	writeHeader(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatFloat(gauge.f()))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func encodeLabels(labels []string, values []string) string {
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=%s", label, strconv.Quote(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(val float64) string {
+
+	if math.IsInf(val, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// DefBuckets default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramSnapshot histogram samples of one label values
+type HistogramSnapshot struct {
+	Buckets []float64 // bucket upper bounds
+	Counts  []uint64  // cumulative counts of buckets
+	Count   uint64    // total samples
+	Sum     float64   // sum of samples
+}
+
+// Histogram samples observations into buckets, nil histogram ignores all updates
+type Histogram struct {
+	sync.Mutex                               // mutex
+	name       string                        // metrics name
+	help       string                        // help text
+	labels     []string                      // label names
+	buckets    []float64                     // bucket upper bounds
+	samples    map[string]*HistogramSnapshot // samples indexed by encoded label values
+	values     map[string][]string           // label values indexed by encoded label values
+}
+
+// Histogram register histogram with bucket upper bounds and label names
+func (registry *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+
+	histogram := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		samples: make(map[string]*HistogramSnapshot),
+		values:  make(map[string][]string),
+	}
+
+	registry.register(name, histogram)
+
+	return histogram
+}
+
+// Observe add one observation of label values
+func (histogram *Histogram) Observe(val float64, values ...string) {
+	if histogram == nil {
+		return
+	}
+
+	histogram.Lock()
+	defer histogram.Unlock()
+
+	key := histogram.key(values)
+
+	sample, ok := histogram.samples[key]
+
+	if !ok {
+		sample = &HistogramSnapshot{
+			Buckets: histogram.buckets,
+			Counts:  make([]uint64, len(histogram.buckets)),
+		}
+
+		histogram.samples[key] = sample
+
+		histogram.values[key] = append([]string(nil), values...)
+	}
+
+	for i, bound := range histogram.buckets {
+		if val <= bound {
+			sample.Counts[i]++
+		}
+	}
+
+	sample.Count++
+
+	sample.Sum += val
+}
+
+// Snapshot get a copy of the samples of label values
+func (histogram *Histogram) Snapshot(values ...string) HistogramSnapshot {
+	if histogram == nil {
+		return HistogramSnapshot{}
+	}
+
+	histogram.Lock()
+	defer histogram.Unlock()
+
+	sample, ok := histogram.samples[histogram.key(values)]
+
+	if !ok {
+		return HistogramSnapshot{
+			Buckets: histogram.buckets,
+			Counts:  make([]uint64, len(histogram.buckets)),
+		}
+	}
+
+	snapshot := *sample
+
+	snapshot.Counts = append([]uint64(nil), sample.Counts...)
+
+	return snapshot
+}
+
+func (histogram *Histogram) key(values []string) string {
+
+	if len(values) != len(histogram.labels) {
+		panic(fmt.Sprintf("metrics %s expect %d label values, got %d", histogram.name, len(histogram.labels), len(values)))
+	}
+
+	return encodeLabels(histogram.labels, values)
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.Lock()
+	defer histogram.Unlock()
+
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+
+	keys := make([]string, 0, len(histogram.samples))
+
+	for key := range histogram.samples {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		sample := histogram.samples[key]
+
+		labels := append(append([]string(nil), histogram.labels...), "le")
+
+		values := histogram.values[key]
+
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, encodeLabels(labels, append(values[:len(values):len(values)], formatFloat(bound))), sample.Counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, encodeLabels(labels, append(values[:len(values):len(values)], "+Inf")), sample.Count)
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, key, formatFloat(sample.Sum))
+
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, key, sample.Count)
+	}
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	registry := New()
+
+	counter := registry.Counter("test_messages_total", "test messages", "service")
+
+	counter.Inc("1")
+
+	counter.Add(2, "1")
+
+	registry.Gauge("test_queue", "test queue").Set(3)
+
+	registry.GaugeFunc("test_clients", "test clients", func() float64 { return 4 })
+
+	var buff bytes.Buffer
+
+	registry.WriteTo(&buff)
+
+	for _, line := range []string{
+		"# TYPE test_messages_total counter",
+		`test_messages_total{service="1"} 3`,
+		"test_queue 3",
+		"test_clients 4",
+	} {
+		if !strings.Contains(buff.String(), line+"\n") {
+			t.Fatalf("expect line %q in\n%s", line, buff.String())
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+
+	var counter *Counter
+
+	counter.Inc()
+
+	if counter.Get() != 0 {
+		t.Fatal("expect nil counter ignore updates")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+
+	registry := New()
+
+	histogram := registry.Histogram("test_duration_seconds", "test duration", []float64{0.1, 1}, "service")
+
+	histogram.Observe(0.05, "1")
+
+	histogram.Observe(0.5, "1")
+
+	histogram.Observe(5, "1")
+
+	snapshot := histogram.Snapshot("1")
+
+	if snapshot.Count != 3 || snapshot.Counts[0] != 1 || snapshot.Counts[1] != 2 {
+		t.Fatalf("unexpected snapshot %v", snapshot)
+	}
+
+	var buff bytes.Buffer
+
+	registry.WriteTo(&buff)
+
+	for _, line := range []string{
+		`test_duration_seconds_bucket{service="1",le="0.1"} 1`,
+		`test_duration_seconds_bucket{service="1",le="+Inf"} 3`,
+		`test_duration_seconds_count{service="1"} 3`,
+	} {
+		if !strings.Contains(buff.String(), line+"\n") {
+			t.Fatalf("expect line %q in\n%s", line, buff.String())
+		}
+	}
+}
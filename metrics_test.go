@@ -0,0 +1,143 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gsdocker/gsproxy/trace"
+	"github.com/gsrpc/gorpc"
+)
+
+func TestMetrics(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if proxy.metrics.forwardMessages.Get("1") != 1 {
+		t.Fatal("expect one forwarded message of service 1")
+	}
+
+	if proxy.metrics.tunnelMessages.Get("1", "forward") != 1 {
+		t.Fatal("expect one forward message of tunnel 1")
+	}
+}
+
+type _MockContext struct {
+	gorpc.Context
+	pipeline gorpc.Pipeline
+}
+
+func (mock *_MockContext) Pipeline() gorpc.Pipeline {
+	return mock.pipeline
+}
+
+func newTunnelResponse(device *gorpc.Device, id uint16) *gorpc.Message {
+
+	tunnel := gorpc.NewTunnel()
+
+	tunnel.ID = device
+
+	tunnel.Message = newCorrelationResponse(id)
+
+	var buff bytes.Buffer
+
+	gorpc.WriteTunnel(&buff, tunnel)
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeTunnel
+
+	message.Content = buff.Bytes()
+
+	return message
+}
+
+func TestLatency(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	context := &_MockContext{pipeline: servers[0]}
+
+	if _, err := servers[0].tunnel.MessageReceived(context, newTunnelResponse(handler.device, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handler.pipeline.(*_MockPipeline).sent) != 1 {
+		t.Fatal("expect response sent to client")
+	}
+
+	if proxy.ServiceLatency(1).Count != 1 || proxy.TunnelLatency(1).Count != 1 {
+		t.Fatal("expect one latency sample")
+	}
+}
+
+func TestLatencyTimeout(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	proxy.timeout = time.Millisecond
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.tunnels = map[uint32]*_TunnelServerHandler{1: servers[0].tunnel}
+
+	proxy.startSweeper()
+
+	defer proxy.stopSweeper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for servers[0].tunnel.InFlight() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if proxy.ServiceLatency(1).Timeouts != 1 || servers[0].tunnel.InFlight() != 0 {
+		t.Fatal("expect the idle tunnel request timeout")
+	}
+}
+
+type _MockCryptoServer struct {
+	gorpc.Handler
+	device *gorpc.Device
+}
+
+func (mock *_MockCryptoServer) GetDevice() *gorpc.Device {
+	return mock.device
+}
+
+func TestHandshakeFailures(t *testing.T) {
+
+	proxy, _, _ := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	for _, dh := range []gorpc.Handler{
+		&_MockCryptoServer{},
+		&_MockCryptoServer{device: gorpc.NewDevice()},
+		&_TLSServer{},
+	} {
+		client := proxy.newClientHandler()
+
+		client.Unregister(&_MockContext{pipeline: &_MockPipeline{dh: dh}})
+	}
+
+	if proxy.metrics.handshakeFailures.Get() != 1 {
+		t.Fatalf("expect only the dh handshake failure counted, got %v", proxy.metrics.handshakeFailures.Get())
+	}
+}
@@ -0,0 +1,298 @@
+package gsproxy
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/gsdocker/gsproxy/trace"
+	"github.com/gsrpc/gorpc"
+)
+
+// _PendingRequest request forwarded to backend tunnel waiting for response
+type _PendingRequest struct {
+	handler *_TransProxyHandler // trans-proxy handler of the requesting client
+	id      uint16              // client request id
+	local   uint16              // proxy request id unique in target tunnel
+	service uint16              // request service
+	method  uint16              // request method
+	tunnel  uint32              // target tunnel id
+	server  Server              // target backend
+	content []byte              // request content, for retry
+	sent    time.Time           // forward time
+	parent  trace.SpanContext   // client trace context
+	span    *trace.Span         // proxy hop span
+}
+
+// message create request message of pending request
+func (pending *_PendingRequest) message() *gorpc.Message {
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeRequest
+
+	message.Content = pending.content
+
+	return message
+}
+
+// track assign request a proxy request id unused in this tunnel, so requests
+// of different clients never collide. the caller must hold the tunnel lock
+// and check available first
+func (handler *_TunnelServerHandler) track(pending *_PendingRequest) error {
+
+	for {
+		handler.idgen++
+
+		if _, ok := handler.pending[handler.idgen]; !ok {
+			break
+		}
+	}
+
+	content, err := rewriteRequest(pending.content, handler.idgen)
+
+	if err != nil {
+		return err
+	}
+
+	pending.local = handler.idgen
+
+	pending.content = content
+
+	handler.pending[pending.local] = pending
+
+	atomic.AddInt64(&handler.inflight, 1)
+
+	atomic.AddInt64(&handler.proxy.inflight, 1)
+
+	return nil
+}
+
+// rewriteRequest replace the request id of request content
+func rewriteRequest(content []byte, id uint16) ([]byte, error) {
+
+	request, err := gorpc.ReadRequest(bytes.NewBuffer(content))
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.ID = id
+
+	var buff bytes.Buffer
+
+	if err := gorpc.WriteRequest(&buff, request); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// restore rewrite backend response to the client request id
+func (pending *_PendingRequest) restore(message *gorpc.Message) error {
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		return err
+	}
+
+	response.ID = pending.id
+
+	var buff bytes.Buffer
+
+	if err := gorpc.WriteResponse(&buff, response); err != nil {
+		return err
+	}
+
+	message.Content = buff.Bytes()
+
+	return nil
+}
+
+// sweep drop requests the client already timed out at most once per rpc timeout
+func (handler *_TunnelServerHandler) sweep(now time.Time) {
+
+	timeout := handler.proxy.timeout
+
+	if timeout <= 0 || now.Sub(handler.swept) < timeout {
+		return
+	}
+
+	handler.swept = now
+
+	for key, pending := range handler.pending {
+
+		if now.Sub(pending.sent) < timeout {
+			continue
+		}
+
+		handler.W("tunnel(%s) request(%d) timeout", pending.handler.device, pending.id)
+
+		delete(handler.pending, key)
+
+		atomic.AddInt64(&handler.inflight, -1)
+
+		atomic.AddInt64(&handler.proxy.inflight, -1)
+
+		handler.proxy.metrics.timedOut(pending.service, handler.id)
+
+		pending.span.Finish(ErrTimeout)
+
+		handler.proxy.access(pending, OutcomeTimeout, 0)
+	}
+}
+
+// startSweeper sweep timed out requests of all tunnels periodically, so idle
+// tunnels release them without waiting for the next request
+func (proxy *_Proxy) startSweeper() {
+
+	if proxy.timeout <= 0 {
+		return
+	}
+
+	proxy.sweeper = make(chan struct{})
+
+	go func(stop chan struct{}) {
+
+		ticker := time.NewTicker(proxy.timeout / 2)
+
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				proxy.sweep(now)
+			}
+		}
+	}(proxy.sweeper)
+}
+
+// stopSweeper stop the sweeper started by startSweeper
+func (proxy *_Proxy) stopSweeper() {
+
+	if proxy.sweeper != nil {
+		close(proxy.sweeper)
+	}
+}
+
+// sweep sweep timed out requests of all tunnels and pump queued requests
+// into the released capacity
+func (proxy *_Proxy) sweep(now time.Time) {
+
+	proxy.RLock()
+
+	tunnels := make([]*_TunnelServerHandler, 0, len(proxy.tunnels))
+
+	for _, tunnel := range proxy.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+
+	proxy.RUnlock()
+
+	for _, tunnel := range tunnels {
+
+		tunnel.Lock()
+
+		tunnel.sweep(now)
+
+		tunnel.Unlock()
+
+		tunnel.pump()
+	}
+}
+
+// removePending stop tracking request by proxy request id, returns false if
+// request is unknown
+func (handler *_TunnelServerHandler) removePending(local uint16) (*_PendingRequest, bool) {
+	handler.Lock()
+	defer handler.Unlock()
+
+	pending, ok := handler.pending[local]
+
+	if !ok {
+		return nil, false
+	}
+
+	delete(handler.pending, local)
+
+	atomic.AddInt64(&handler.inflight, -1)
+
+	atomic.AddInt64(&handler.proxy.inflight, -1)
+
+	return pending, true
+}
+
+// drainPending stop tracking all in-flight and queued requests of the closed tunnel
+func (handler *_TunnelServerHandler) drainPending() []*_PendingRequest {
+	handler.Lock()
+	defer handler.Unlock()
+
+	var drained []*_PendingRequest
+
+	for _, pending := range handler.pending {
+		drained = append(drained, pending)
+	}
+
+	handler.pending = make(map[uint16]*_PendingRequest)
+
+	atomic.AddInt64(&handler.inflight, -int64(len(drained)))
+
+	atomic.AddInt64(&handler.proxy.inflight, -int64(len(drained)))
+
+	drained = append(drained, handler.queue...)
+
+	handler.queue = nil
+
+	handler.proxy.metrics.queued(handler.id, 0)
+
+	return drained
+}
+
+// failPending retry idempotent requests on another backend, otherwise answer
+// the client with ExceptionTunnelClosed
+func (proxy *_Proxy) failPending(pending *_PendingRequest) {
+
+	pending.span.Finish(ErrTunnelClosed)
+
+	if proxy.idempotent[pending.service] {
+
+		if server, ok := pending.handler.transproxy(pending.service); ok {
+
+			request := gorpc.NewRequest()
+
+			request.ID = pending.id
+
+			request.Service = pending.service
+
+			request.Method = pending.method
+
+			if err := pending.handler.forwardRequest(server, pending.message(), request, pending.parent); err == nil {
+				proxy.I("retry tunnel(%s) request(%d) on another backend", pending.handler.device, pending.id)
+				proxy.access(pending, OutcomeRetried, 0)
+				return
+			}
+		}
+	}
+
+	proxy.access(pending, OutcomeTunnelClosed, 0)
+
+	proxy.reject(pending, ExceptionTunnelClosed)
+}
+
+// reject answer the client of pending request with proxy exception
+func (proxy *_Proxy) reject(pending *_PendingRequest, exception int8) {
+
+	message, err := newErrorResponse(pending.id, pending.service, exception)
+
+	if err != nil {
+		proxy.E("create tunnel(%s) request(%d) error response -- failed\n%s", pending.handler.device, pending.id, err)
+		return
+	}
+
+	if err := pending.handler.pipeline.SendMessage(message); err != nil {
+		proxy.E("answer tunnel(%s) request(%d) -- failed\n%s", pending.handler.device, pending.id, err)
+	}
+}
@@ -0,0 +1,204 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/trace"
+	"github.com/gsrpc/gorpc"
+)
+
+func newPendingProxy() (*_Proxy, *_TransProxyHandler, []*_MockPipeline) {
+
+	proxy := newRegistryProxy(&_MockProxy{})
+
+	proxy.router = newRouter(NewRoundRobin(), nil)
+
+	proxy.idempotent = make(map[uint16]bool)
+
+	var servers []*_MockPipeline
+
+	for i := 0; i < 2; i++ {
+
+		server := &_MockPipeline{
+			tunnel: &_TunnelServerHandler{
+				Log:     gslogger.Get("gsproxy-test"),
+				proxy:   proxy,
+				id:      uint32(i + 1),
+				pending: make(map[uint16]*_PendingRequest),
+			},
+		}
+
+		servers = append(servers, server)
+	}
+
+	proxy.router.add(servers[0], []*gorpc.NamedService{newNamedService(1)})
+
+	handler := proxy.newTransProxyHandler().(*_TransProxyHandler)
+
+	handler.device = gorpc.NewDevice()
+
+	handler.pipeline = &_MockPipeline{}
+
+	return proxy, handler, servers
+}
+
+func newPendingMessage() *gorpc.Message {
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeRequest
+
+	return message
+}
+
+func newRequestMessage(id uint16, service uint16) *gorpc.Message {
+
+	var buff bytes.Buffer
+
+	gorpc.WriteRequest(&buff, newPendingRequest(id, service))
+
+	message := newPendingMessage()
+
+	message.Content = buff.Bytes()
+
+	return message
+}
+
+func newPendingRequest(id uint16, service uint16) *gorpc.Request {
+
+	request := gorpc.NewRequest()
+
+	request.ID = id
+
+	request.Service = service
+
+	return request
+}
+
+func TestPendingTunnelClosed(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if servers[0].tunnel.InFlight() != 1 {
+		t.Fatal("expect one in-flight request")
+	}
+
+	proxy.router.remove(servers[0])
+
+	for _, pending := range servers[0].tunnel.drainPending() {
+		proxy.failPending(pending)
+	}
+
+	client := handler.pipeline.(*_MockPipeline)
+
+	if len(client.sent) != 1 || client.sent[0].Code != gorpc.CodeResponse {
+		t.Fatal("expect error response sent to client")
+	}
+
+	if proxy.inflight != 0 {
+		t.Fatalf("expect no in-flight request, got %d", proxy.inflight)
+	}
+}
+
+func TestPendingRetry(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.idempotent[1] = true
+
+	proxy.router.add(servers[1], []*gorpc.NamedService{newNamedService(1)})
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.router.remove(servers[0])
+
+	for _, pending := range servers[0].tunnel.drainPending() {
+		proxy.failPending(pending)
+	}
+
+	if len(servers[1].sent) != 1 || servers[1].tunnel.InFlight() != 1 {
+		t.Fatal("expect request retried on the alive backend")
+	}
+
+	if len(handler.pipeline.(*_MockPipeline).sent) != 0 {
+		t.Fatal("expect no error response")
+	}
+}
+
+func TestPendingRequestID(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	other := proxy.newTransProxyHandler().(*_TransProxyHandler)
+
+	other.device = gorpc.NewDevice()
+
+	other.pipeline = &_MockPipeline{}
+
+	for _, client := range []*_TransProxyHandler{handler, other} {
+		if err := client.forwardRequest(servers[0], newRequestMessage(7, 1), newPendingRequest(7, 1), trace.SpanContext{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if servers[0].tunnel.InFlight() != 2 || proxy.inflight != 2 {
+		t.Fatal("expect requests of different clients tracked separately")
+	}
+
+	var locals []uint16
+
+	for _, message := range servers[0].sent {
+
+		tunnel, err := gorpc.ReadTunnel(bytes.NewBuffer(message.Content))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, err := gorpc.ReadRequest(bytes.NewBuffer(tunnel.Message.Content))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locals = append(locals, request.ID)
+	}
+
+	if len(locals) != 2 || locals[0] == locals[1] {
+		t.Fatal("expect proxy request ids unique in tunnel")
+	}
+
+	context := &_MockContext{pipeline: servers[0]}
+
+	if _, err := servers[0].tunnel.MessageReceived(context, newTunnelResponse(other.device, locals[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := other.pipeline.(*_MockPipeline).sent
+
+	if len(sent) != 1 || len(handler.pipeline.(*_MockPipeline).sent) != 0 {
+		t.Fatal("expect response routed to the requesting client")
+	}
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(sent[0].Content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != 7 {
+		t.Fatalf("expect client request id restored, got %d", response.ID)
+	}
+
+	if servers[0].tunnel.InFlight() != 1 {
+		t.Fatal("expect one in-flight request left")
+	}
+}
@@ -0,0 +1,317 @@
+package gsproxy
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/gsdocker/gslogger"
+	"github.com/gsdocker/gsproxy/trace"
+	"github.com/gsrpc/gorpc"
+	gorpcHandler "github.com/gsrpc/gorpc/handler"
+)
+
+var rateLimitHandler = "gsproxy-ratelimit"
+
+// RateLimit token bucket config, refills Rate tokens per second up to Burst
+// tokens, zero Rate disables the limit
+type RateLimit struct {
+	Rate  float64 // tokens per second
+	Burst int     // bucket capacity
+}
+
+func (limit RateLimit) enabled() bool {
+	return limit.Rate > 0
+}
+
+type _TokenBucket struct {
+	rate   float64   // tokens per second
+	burst  float64   // bucket capacity
+	tokens float64   // available tokens
+	last   time.Time // last refill time
+}
+
+// capacity bucket capacity, defaults to one second of tokens
+func (limit RateLimit) capacity() float64 {
+
+	burst := float64(limit.Burst)
+
+	if burst < 1 {
+		burst = limit.Rate
+
+		if burst < 1 {
+			burst = 1
+		}
+	}
+
+	return burst
+}
+
+func newTokenBucket(limit RateLimit) *_TokenBucket {
+
+	burst := limit.capacity()
+
+	return &_TokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take take one token, returns false if the bucket is empty
+func (bucket *_TokenBucket) take(now time.Time) bool {
+
+	if now.After(bucket.last) {
+
+		bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// refund give back the token taken by take
+func (bucket *_TokenBucket) refund() {
+
+	bucket.tokens++
+
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+}
+
+// _RateLimiter rate limit config shared by all frontend connections
+type _RateLimiter struct {
+	device     RateLimit            // per device limit
+	service    RateLimit            // default per device per service limit
+	services   map[uint16]RateLimit // per device per service limit overrides
+	disconnect bool                 // close the connection instead of responding error
+}
+
+func (limiter *_RateLimiter) serviceLimit(service uint16) RateLimit {
+
+	if limit, ok := limiter.services[service]; ok {
+		return limit
+	}
+
+	return limiter.service
+}
+
+// idle time to refill every bucket, buckets idle longer are equal to new ones
+func (limiter *_RateLimiter) idle() time.Duration {
+
+	idle := time.Minute
+
+	limits := []RateLimit{limiter.device, limiter.service}
+
+	for _, limit := range limiter.services {
+		limits = append(limits, limit)
+	}
+
+	for _, limit := range limits {
+
+		if !limit.enabled() {
+			continue
+		}
+
+		refill := time.Duration(limit.capacity() / limit.Rate * float64(time.Second))
+
+		if refill > idle {
+			idle = refill
+		}
+	}
+
+	return idle
+}
+
+// _DeviceBuckets token buckets of one device shared by all its sessions
+type _DeviceBuckets struct {
+	device   *_TokenBucket            // device bucket, nil if unlimited
+	services map[uint16]*_TokenBucket // service buckets
+	used     time.Time                // last request time
+}
+
+// _BucketTable device buckets indexed by device name
+type _BucketTable struct {
+	sync.Mutex                            // mutex
+	devices    map[string]*_DeviceBuckets // device buckets
+	swept      time.Time                  // last idle buckets sweep time
+}
+
+// allow take tokens of device bucket and service bucket
+func (proxy *_Proxy) allow(device string, service uint16) bool {
+
+	table := &proxy.buckets
+
+	table.Lock()
+	defer table.Unlock()
+
+	now := time.Now()
+
+	table.sweep(now, proxy.limiter.idle())
+
+	buckets, ok := table.devices[device]
+
+	if !ok {
+		buckets = &_DeviceBuckets{
+			services: make(map[uint16]*_TokenBucket),
+		}
+
+		if proxy.limiter.device.enabled() {
+			buckets.device = newTokenBucket(proxy.limiter.device)
+		}
+
+		table.devices[device] = buckets
+	}
+
+	buckets.used = now
+
+	bucket, ok := buckets.services[service]
+
+	if !ok {
+
+		if limit := proxy.limiter.serviceLimit(service); limit.enabled() {
+			bucket = newTokenBucket(limit)
+		}
+
+		buckets.services[service] = bucket
+	}
+
+	if bucket != nil && !bucket.take(now) {
+		return false
+	}
+
+	if buckets.device != nil && !buckets.device.take(now) {
+
+		// the request is rejected, keep the service quota
+		if bucket != nil {
+			bucket.refund()
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// sweep drop buckets of devices idle longer than idle at most once per idle,
+// the caller must hold the table lock
+func (table *_BucketTable) sweep(now time.Time, idle time.Duration) {
+
+	if table.devices == nil {
+		table.devices = make(map[string]*_DeviceBuckets)
+		table.swept = now
+	}
+
+	if now.Sub(table.swept) < idle {
+		return
+	}
+
+	table.swept = now
+
+	for device, buckets := range table.devices {
+		if now.Sub(buckets.used) >= idle {
+			delete(table.devices, device)
+		}
+	}
+}
+
+type _RateLimitHandler struct {
+	gslogger.Log         // mixin log
+	proxy        *_Proxy // proxy
+	device       string  // device name
+}
+
+func (proxy *_Proxy) newRateLimitHandler() gorpc.Handler {
+
+	return &_RateLimitHandler{
+		Log:   gslogger.Get("ratelimit"),
+		proxy: proxy,
+	}
+}
+
+func (handler *_RateLimitHandler) Register(context gorpc.Context) error {
+	return nil
+}
+
+func (handler *_RateLimitHandler) Active(context gorpc.Context) error {
+
+	dh, _ := context.Pipeline().Handler(dhHandler)
+
+	handler.device = dh.(gorpcHandler.CryptoServer).GetDevice().String()
+
+	return nil
+}
+
+func (handler *_RateLimitHandler) Unregister(context gorpc.Context) {
+}
+
+func (handler *_RateLimitHandler) Inactive(context gorpc.Context) {
+}
+
+func (handler *_RateLimitHandler) MessageReceived(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+
+	if message.Code != gorpc.CodeRequest {
+		return message, nil
+	}
+
+	content := message.Content
+
+	if message.Agent == trace.MessageFlag {
+		if _, content, _ = trace.Decode(message.Content); content == nil {
+			// let trans proxy handler report the broken message
+			return message, nil
+		}
+	}
+
+	request, err := gorpc.ReadRequest(bytes.NewBuffer(content))
+
+	if err != nil {
+		return message, nil
+	}
+
+	if handler.proxy.allow(handler.device, request.Service) {
+		return message, nil
+	}
+
+	handler.proxy.metrics.rateLimited(request.Service)
+
+	if handler.proxy.limiter.disconnect {
+		handler.W("[%s] request(%d) of service(%d) exceeds rate limit, disconnect", context.Name(), request.ID, request.Service)
+		context.Close()
+		return nil, ErrRateLimited
+	}
+
+	handler.D("[%s] request(%d) of service(%d) exceeds rate limit", context.Name(), request.ID, request.Service)
+
+	response, err := newErrorResponse(request.ID, request.Service, ExceptionRateLimited)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := context.Pipeline().SendMessage(response); err != nil {
+		handler.E("[%s] send rate limit response error\n%s", context.Name(), err)
+	}
+
+	return nil, nil
+}
+
+func (handler *_RateLimitHandler) MessageSending(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+	return message, nil
+}
+
+func (handler *_RateLimitHandler) Panic(context gorpc.Context, err error) {
+}
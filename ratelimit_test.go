@@ -0,0 +1,175 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+type _MockNamedContext struct {
+	_MockContext
+	closed bool
+}
+
+func (mock *_MockNamedContext) Name() string {
+	return "mock"
+}
+
+func (mock *_MockNamedContext) Close() {
+	mock.closed = true
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	bucket := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+
+	now := bucket.last
+
+	if !bucket.take(now) || !bucket.take(now) {
+		t.Fatal("expect burst tokens")
+	}
+
+	if bucket.take(now) {
+		t.Fatal("expect bucket empty")
+	}
+
+	if !bucket.take(now.Add(time.Millisecond * 100)) {
+		t.Fatal("expect bucket refilled")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	proxy, _, _ := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	proxy.limiter = &_RateLimiter{
+		services: map[uint16]RateLimit{
+			1: {Rate: 1, Burst: 1},
+		},
+	}
+
+	handler := proxy.newRateLimitHandler()
+
+	pipeline := &_MockPipeline{dh: &_TLSServer{device: gorpc.NewDevice()}}
+
+	context := &_MockNamedContext{_MockContext: _MockContext{pipeline: pipeline}}
+
+	handler.Active(context)
+
+	if message, _ := handler.MessageReceived(context, newRequestMessage(1, 1)); message == nil {
+		t.Fatal("expect first request passed")
+	}
+
+	if message, _ := handler.MessageReceived(context, newRequestMessage(2, 2)); message == nil {
+		t.Fatal("expect unlimited service passed")
+	}
+
+	if message, _ := handler.MessageReceived(context, newRequestMessage(3, 1)); message != nil {
+		t.Fatal("expect second request limited")
+	}
+
+	if len(pipeline.sent) != 1 {
+		t.Fatal("expect error response sent")
+	}
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(pipeline.sent[0].Content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != 3 || response.Exception != ExceptionRateLimited {
+		t.Fatal("expect rate limited response of request 3")
+	}
+
+	if proxy.metrics.rateLimits.Get("1") != 1 {
+		t.Fatal("expect one rate limited request")
+	}
+
+	proxy.limiter.disconnect = true
+
+	if _, err := handler.MessageReceived(context, newRequestMessage(4, 1)); err != ErrRateLimited || !context.closed {
+		t.Fatal("expect disconnect")
+	}
+}
+
+func TestRateLimitDevice(t *testing.T) {
+
+	proxy, _, _ := newPendingProxy()
+
+	proxy.limiter = &_RateLimiter{
+		device: RateLimit{Rate: 1, Burst: 1},
+	}
+
+	device := gorpc.NewDevice()
+
+	device.ID = "device"
+
+	var contexts []*_MockNamedContext
+
+	var handlers []gorpc.Handler
+
+	// two sessions of the same device share the device bucket
+	for i := 0; i < 2; i++ {
+
+		handler := proxy.newRateLimitHandler()
+
+		context := &_MockNamedContext{_MockContext: _MockContext{pipeline: &_MockPipeline{dh: &_TLSServer{device: device}}}}
+
+		handler.Active(context)
+
+		handlers = append(handlers, handler)
+
+		contexts = append(contexts, context)
+	}
+
+	if message, _ := handlers[0].MessageReceived(contexts[0], newRequestMessage(1, 1)); message == nil {
+		t.Fatal("expect first request passed")
+	}
+
+	if message, _ := handlers[1].MessageReceived(contexts[1], newRequestMessage(1, 1)); message != nil {
+		t.Fatal("expect reconnected session limited by device bucket")
+	}
+
+	now := time.Now().Add(proxy.limiter.idle())
+
+	proxy.buckets.Lock()
+
+	proxy.buckets.sweep(now, proxy.limiter.idle())
+
+	expired := len(proxy.buckets.devices) == 0
+
+	proxy.buckets.Unlock()
+
+	if !expired {
+		t.Fatal("expect idle device buckets expired")
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+
+	proxy, _, _ := newPendingProxy()
+
+	proxy.limiter = &_RateLimiter{
+		device:  RateLimit{Rate: 1, Burst: 1},
+		service: RateLimit{Rate: 1, Burst: 2},
+	}
+
+	if !proxy.allow("device", 1) {
+		t.Fatal("expect first request passed")
+	}
+
+	if proxy.allow("device", 1) {
+		t.Fatal("expect second request limited by device bucket")
+	}
+
+	bucket := proxy.buckets.devices["device"].services[1]
+
+	if bucket.tokens < 1 {
+		t.Fatal("expect service token refunded on device limit rejection")
+	}
+}
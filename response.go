@@ -0,0 +1,49 @@
+package gsproxy
+
+import (
+	"bytes"
+
+	"github.com/gsrpc/gorpc"
+)
+
+// Exception codes of the error responses generated by gsproxy itself, negative
+// to never collide with the exception indexes of backend services
+const (
+	// ExceptionTunnelClosed the backend tunnel closed before responding
+	ExceptionTunnelClosed int8 = -100 - iota
+	// ExceptionRateLimited the request exceeds the device or service rate limit
+	ExceptionRateLimited
+	// ExceptionOverloaded the backend is saturated and the request queue is full,
+	// the request was not forwarded and is safe to retry
+	ExceptionOverloaded
+	// ExceptionForbidden the client is not allowed to call the service
+	ExceptionForbidden
+	// ExceptionClosed the proxy is shutting down and no longer forwards requests
+	ExceptionClosed
+)
+
+// newErrorResponse create response message of request with proxy exception code
+func newErrorResponse(id uint16, service uint16, exception int8) (*gorpc.Message, error) {
+
+	response := gorpc.NewResponse()
+
+	response.ID = id
+
+	response.Service = service
+
+	response.Exception = exception
+
+	var buff bytes.Buffer
+
+	if err := gorpc.WriteResponse(&buff, response); err != nil {
+		return nil, err
+	}
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeResponse
+
+	message.Content = buff.Bytes()
+
+	return message, nil
+}
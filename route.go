@@ -0,0 +1,84 @@
+package gsproxy
+
+import (
+	"sync"
+
+	"github.com/gsrpc/gorpc"
+)
+
+// _Router the service table built from backend TunnelWhoAmI announcements
+type _Router struct {
+	sync.RWMutex                     // mutex
+	services     map[uint16][]Server // backend servers indexed by service id
+	balancer     Balancer            // balancer
+	affinity     *_Affinity          // sticky sessions, nil if disabled
+}
+
+func newRouter(balancer Balancer, affinity *_Affinity) *_Router {
+	return &_Router{
+		services: make(map[uint16][]Server),
+		balancer: balancer,
+		affinity: affinity,
+	}
+}
+
+// add register server as the provider of announced services
+func (router *_Router) add(server Server, services []*gorpc.NamedService) {
+	router.Lock()
+	defer router.Unlock()
+
+	for _, service := range services {
+		router.services[service.DispatchID] = append(router.services[service.DispatchID], server)
+	}
+}
+
+// remove remove server from all services it provides
+func (router *_Router) remove(server Server) {
+	router.Lock()
+	defer router.Unlock()
+
+	for id, servers := range router.services {
+
+		var alive []Server
+
+		for _, target := range servers {
+			if target != server {
+				alive = append(alive, target)
+			}
+		}
+
+		if len(alive) == 0 {
+			delete(router.services, id)
+		} else {
+			router.services[id] = alive
+		}
+	}
+}
+
+// route get the backend server of service for device
+func (router *_Router) route(service uint16, device *gorpc.Device) (Server, bool) {
+	router.RLock()
+
+	servers := router.services[service]
+
+	router.RUnlock()
+
+	if router.affinity != nil {
+		return router.affinity.route(service, device, servers, router.selectServer)
+	}
+
+	return router.selectServer(service, device, servers)
+}
+
+func (router *_Router) selectServer(service uint16, device *gorpc.Device, servers []Server) (Server, bool) {
+
+	if len(servers) == 0 {
+		return nil, false
+	}
+
+	if len(servers) == 1 {
+		return servers[0], true
+	}
+
+	return router.balancer.Select(service, device, servers), true
+}
@@ -0,0 +1,91 @@
+package gsproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func newNamedService(id uint16) *gorpc.NamedService {
+
+	service := gorpc.NewNamedService()
+
+	service.DispatchID = id
+
+	return service
+}
+
+func TestRouter(t *testing.T) {
+
+	router := newRouter(NewRoundRobin(), nil)
+
+	device := gorpc.NewDevice()
+
+	first := &_MockPipeline{}
+
+	second := &_MockPipeline{}
+
+	router.add(first, []*gorpc.NamedService{newNamedService(1), newNamedService(2)})
+
+	router.add(second, []*gorpc.NamedService{newNamedService(2)})
+
+	if server, ok := router.route(1, device); !ok || server != first {
+		t.Fatal("expect route service 1 to first server")
+	}
+
+	router.remove(first)
+
+	if _, ok := router.route(1, device); ok {
+		t.Fatal("expect service 1 unrouted")
+	}
+
+	if server, ok := router.route(2, device); !ok || server != second {
+		t.Fatal("expect route service 2 to second server")
+	}
+}
+
+func TestAffinity(t *testing.T) {
+
+	affinity := newAffinity(time.Minute)
+
+	var failover int
+
+	affinity.failover = func(device *gorpc.Device, service uint16, from Server, to Server) {
+		failover++
+	}
+
+	router := newRouter(NewRoundRobin(), affinity)
+
+	servers := newBalancerServers(3)
+
+	for _, server := range servers {
+		router.add(server, []*gorpc.NamedService{newNamedService(1)})
+	}
+
+	device := gorpc.NewDevice()
+
+	selected, _ := router.route(1, device)
+
+	for i := 0; i < 10; i++ {
+		if server, _ := router.route(1, device); server != selected {
+			t.Fatal("expect sticky server")
+		}
+	}
+
+	router.remove(selected)
+
+	moved, ok := router.route(1, device)
+
+	if !ok || moved == selected {
+		t.Fatal("expect failover to an alive server")
+	}
+
+	if failover != 1 {
+		t.Fatalf("expect one failover notification, got %d", failover)
+	}
+
+	if server, _ := router.route(1, device); server != moved {
+		t.Fatal("expect sticky to the new server")
+	}
+}
@@ -0,0 +1,60 @@
+package gsproxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ClaimServices claim of comma separated service ids the client may call, set
+// by Authenticator to restrict the client
+const ClaimServices = "services"
+
+// parseServiceACL parse ClaimServices claim value
+func parseServiceACL(value string) ([]uint16, error) {
+
+	services := make([]uint16, 0)
+
+	for _, field := range strings.Split(value, ",") {
+
+		field = strings.TrimSpace(field)
+
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseUint(field, 0, 16)
+
+		if err != nil {
+			return nil, err
+		}
+
+		services = append(services, uint16(id))
+	}
+
+	return services, nil
+}
+
+// setACL restrict services client may call, nil removes the restriction
+func (handler *_TransProxyHandler) setACL(services []uint16) {
+	handler.Lock()
+	defer handler.Unlock()
+
+	if services == nil {
+		handler.acl = nil
+		return
+	}
+
+	handler.acl = make(map[uint16]bool, len(services))
+
+	for _, service := range services {
+		handler.acl[service] = true
+	}
+}
+
+// allowed check if client may call service
+func (handler *_TransProxyHandler) allowed(service uint16) bool {
+	handler.RLock()
+	defer handler.RUnlock()
+
+	return handler.acl == nil || handler.acl[service]
+}
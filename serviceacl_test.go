@@ -0,0 +1,92 @@
+package gsproxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func TestServiceACL(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	proxy.metrics = proxy.newMetrics()
+
+	pipeline := handler.pipeline.(*_MockPipeline)
+
+	context := &_MockContext{pipeline: pipeline}
+
+	handler.setACL([]uint16{2})
+
+	if _, err := handler.MessageReceived(context, newRequestMessage(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers[0].sent) != 0 || len(pipeline.sent) != 1 {
+		t.Fatal("expect forbidden request answered by proxy")
+	}
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(pipeline.sent[0].Content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != 1 || response.Exception != ExceptionForbidden {
+		t.Fatal("expect forbidden exception")
+	}
+
+	if proxy.metrics.forbiddens.Get("1") != 1 {
+		t.Fatal("expect one forbidden request")
+	}
+
+	if forward, err := handler.MessageReceived(context, newRequestMessage(3, 3)); forward == nil || err != nil {
+		t.Fatal("expect proxy local service passed through acl")
+	}
+
+	handler.setACL(nil)
+
+	if _, err := handler.MessageReceived(context, newRequestMessage(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(servers[0].sent) != 1 {
+		t.Fatal("expect request forwarded without acl")
+	}
+}
+
+func TestServiceACLClaim(t *testing.T) {
+
+	services, err := parseServiceACL("1, 0x10,")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 2 || services[0] != 1 || services[1] != 16 {
+		t.Fatalf("unexpect services %v", services)
+	}
+
+	if _, err := parseServiceACL("1,login"); err == nil {
+		t.Fatal("expect invalid service id error")
+	}
+
+	proxy, transproxy, _ := newPendingProxy()
+
+	context := newAuthContext("device")
+
+	context.pipeline.(*_MockPipeline).auth = &_AuthHandler{claims: Claims{ClaimServices: "invalid"}}
+
+	context.pipeline.(*_MockPipeline).transproxy = transproxy
+
+	client := proxy.newClientHandler().(*_Client)
+
+	if err := client.Active(context); err != nil {
+		t.Fatal(err)
+	}
+
+	if transproxy.allowed(1) {
+		t.Fatal("expect invalid claim denies all services")
+	}
+}
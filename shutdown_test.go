@@ -0,0 +1,180 @@
+package gsproxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gsdocker/gsproxy/trace"
+	"github.com/gsrpc/gorpc"
+)
+
+type _MockShutdownProxy struct {
+	_MockRegistryProxy
+	unbound      int
+	unregistered int
+}
+
+func (mock *_MockShutdownProxy) UnbindServices(context Context, server Server) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.unbound++
+}
+
+func (mock *_MockShutdownProxy) Unregister(context Context) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.unregistered++
+}
+
+func newShutdownProxy(t *testing.T) (*_Proxy, *_TransProxyHandler, []*_MockPipeline, *_MockShutdownProxy) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	mock := &_MockShutdownProxy{}
+
+	proxy.proxy = mock
+
+	proxy.tunnels = make(map[uint32]*_TunnelServerHandler)
+
+	proxy.servers = map[uint32]Server{1: servers[0]}
+
+	proxy.addClient(newRegistryClient(proxy, "device"))
+
+	var err error
+
+	if proxy.listenerF, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if proxy.listenerB, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), trace.SpanContext{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return proxy, handler, servers, mock
+}
+
+func TestShutdown(t *testing.T) {
+
+	proxy, handler, servers, mock := newShutdownProxy(t)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- proxy.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expect shutdown waits in-flight request")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if _, err := proxy.listenerF.Accept(); err == nil {
+		t.Fatal("expect frontend listener closed")
+	}
+
+	if _, err := proxy.listenerB.Accept(); err == nil {
+		t.Fatal("expect backend listener closed")
+	}
+
+	if _, err := servers[0].tunnel.MessageReceived(&_MockContext{pipeline: servers[0]}, newTunnelResponse(handler.device, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect shutdown finished after in-flight request answered")
+	}
+
+	if mock.removed != 1 || mock.unbound != 1 || mock.unregistered != 1 || !servers[0].closed {
+		t.Fatal("expect clients removed, services unbound and proxy unregistered")
+	}
+
+	if err := proxy.Shutdown(context.Background()); err != nil || mock.unregistered != 1 {
+		t.Fatal("expect shutdown runs once")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+
+	proxy, _, servers, mock := newShutdownProxy(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+
+	defer cancel()
+
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect drain deadline exceeded, got %v", err)
+	}
+
+	if mock.removed != 1 || mock.unbound != 1 || mock.unregistered != 1 || !servers[0].closed {
+		t.Fatal("expect shutdown completed after drain deadline")
+	}
+}
+
+func TestCloseDrain(t *testing.T) {
+
+	proxy, _, _, mock := newShutdownProxy(t)
+
+	proxy.drain = time.Millisecond * 20
+
+	start := time.Now()
+
+	proxy.Close()
+
+	if time.Since(start) < proxy.drain || mock.unregistered != 1 {
+		t.Fatal("expect close waits the drain timeout")
+	}
+}
+
+func TestShutdownRejectRequest(t *testing.T) {
+
+	proxy, handler, servers, _ := newShutdownProxy(t)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- proxy.Shutdown(context.Background())
+	}()
+
+	for !proxy.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	pipeline := &_MockPipeline{}
+
+	if _, err := handler.MessageReceived(&_MockContext{pipeline: pipeline}, newRequestMessage(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipeline.sent) != 1 {
+		t.Fatal("expect request answered while draining")
+	}
+
+	response, err := gorpc.ReadResponse(bytes.NewBuffer(pipeline.sent[0].Content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != 2 || response.Exception != ExceptionClosed {
+		t.Fatal("expect ExceptionClosed response")
+	}
+
+	servers[0].tunnel.MessageReceived(&_MockContext{pipeline: servers[0]}, newTunnelResponse(handler.device, 1))
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
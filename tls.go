@@ -0,0 +1,300 @@
+package gsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/gsdocker/gslogger"
+	"github.com/gsrpc/gorpc"
+)
+
+// Errors of the tls frontend
+var (
+	// ErrTLSState frontend connection has no completed tls handshake
+	ErrTLSState = errors.New("gsproxy tls connection state not found")
+	// ErrDeviceIdentity tls frontend device can not be identified
+	ErrDeviceIdentity = errors.New("gsproxy device identity rejected")
+	// ErrTLSClientCA certificate identifier used without client ca
+	ErrTLSClientCA = errors.New("gsproxy tls certificate identifier requires client ca")
+	// ErrHandshake frontend client sent message before WhoAmI
+	ErrHandshake = errors.New("gsproxy expect WhoAmI message")
+)
+
+// TLSIdentifier identify the device of tls frontend connection from the
+// verified client certificate, nil if the client sent none, and the WhoAmI
+// message the client sends first
+type TLSIdentifier interface {
+	Identify(cert *x509.Certificate, whoAmI *gorpc.WhoAmI) (*gorpc.Device, error)
+}
+
+// TLSIdentifierF function as TLSIdentifier
+type TLSIdentifierF func(cert *x509.Certificate, whoAmI *gorpc.WhoAmI) (*gorpc.Device, error)
+
+// Identify implement TLSIdentifier
+func (f TLSIdentifierF) Identify(cert *x509.Certificate, whoAmI *gorpc.WhoAmI) (*gorpc.Device, error) {
+	return f(cert, whoAmI)
+}
+
+// CertIdentifier identify device by client certificate common name, the
+// frontend must be built with a client ca
+func CertIdentifier() TLSIdentifier {
+	return _CertIdentifier{}
+}
+
+type _CertIdentifier struct{}
+
+func (identifier _CertIdentifier) Identify(cert *x509.Certificate, whoAmI *gorpc.WhoAmI) (*gorpc.Device, error) {
+
+	if cert == nil || cert.Subject.CommonName == "" {
+		return nil, ErrDeviceIdentity
+	}
+
+	device := gorpc.NewDevice()
+
+	if whoAmI.ID != nil {
+		*device = *whoAmI.ID
+	}
+
+	device.ID = cert.Subject.CommonName
+
+	return device, nil
+}
+
+// TokenIdentifier identify device by WhoAmI id if verify accepts the token
+// carried in WhoAmI context
+func TokenIdentifier(verify func(device *gorpc.Device, token []byte) error) TLSIdentifier {
+	return TLSIdentifierF(func(cert *x509.Certificate, whoAmI *gorpc.WhoAmI) (*gorpc.Device, error) {
+
+		if whoAmI.ID == nil {
+			return nil, ErrDeviceIdentity
+		}
+
+		if err := verify(whoAmI.ID, whoAmI.Context); err != nil {
+			return nil, err
+		}
+
+		return whoAmI.ID, nil
+	})
+}
+
+// loadServerTLS load listener tls config, returns nil config if cert is empty.
+// clients must present certificate signed by clientCA if clientCA is not empty
+func loadServerTLS(cert string, key string, clientCA string) (*tls.Config, error) {
+
+	if cert == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+
+		pool, err := loadCertPool(clientCA)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// handshakeTLS complete tls handshake of frontend connection and keep its
+// state for the tls server handler of the pipeline named name
+func (proxy *_Proxy) handshakeTLS(name string, conn *tls.Conn) error {
+
+	if proxy.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(proxy.timeout))
+	}
+
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.tlsStates[name] = &state
+
+	return nil
+}
+
+// tlsState take tls state of pipeline
+func (proxy *_Proxy) tlsState(name string) (*tls.ConnectionState, bool) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	state, ok := proxy.tlsStates[name]
+
+	delete(proxy.tlsStates, name)
+
+	return state, ok
+}
+
+// serve hand the admitted connection to accept, completing tls handshake first
+// if frontend terminates tls. the connection is closed if accept failed
+func (proxy *_Proxy) serve(accept func(name string, conn net.Conn) error, conn net.Conn, tlsConn *tls.Conn) {
+
+	name := conn.RemoteAddr().String()
+
+	if tlsConn != nil {
+
+		if err := proxy.handshakeTLS(name, tlsConn); err != nil {
+			proxy.W("tls handshake with %s error :%s", name, err)
+			proxy.metrics.handshakeFailed()
+			conn.Close()
+			return
+		}
+	}
+
+	if err := accept(name, conn); err != nil {
+		proxy.E("accept connection from %s error :%s", name, err)
+
+		// drop the tls state no pipeline will take
+		proxy.tlsState(name)
+
+		conn.Close()
+	}
+}
+
+// _TLSServer frontend handler registered as the dh handler when the proxy
+// terminates tls, identifies the device from the WhoAmI message
+type _TLSServer struct {
+	gslogger.Log                      // mixin log APIs
+	proxy        *_Proxy              // proxy
+	identifier   TLSIdentifier        // device identifier
+	state        *tls.ConnectionState // tls connection state
+	device       *gorpc.Device        // identified device
+}
+
+func (proxy *_Proxy) newTLSServer(identifier TLSIdentifier) gorpc.Handler {
+	return &_TLSServer{
+		Log:        gslogger.Get("gsproxy-tls"),
+		proxy:      proxy,
+		identifier: identifier,
+	}
+}
+
+// GetDevice implement handler.CryptoServer
+func (handler *_TLSServer) GetDevice() *gorpc.Device {
+	return handler.device
+}
+
+func (handler *_TLSServer) Register(context gorpc.Context) error {
+
+	state, ok := handler.proxy.tlsState(context.Pipeline().Name())
+
+	if !ok {
+		return ErrTLSState
+	}
+
+	handler.state = state
+
+	return nil
+}
+
+func (handler *_TLSServer) Active(context gorpc.Context) error {
+	return gorpc.ErrSkip
+}
+
+func (handler *_TLSServer) Unregister(context gorpc.Context) {
+}
+
+func (handler *_TLSServer) Inactive(context gorpc.Context) {
+}
+
+func (handler *_TLSServer) MessageReceived(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+
+	if handler.device != nil {
+		return message, nil
+	}
+
+	if message.Code != gorpc.CodeWhoAmI {
+		handler.E("[%s] unexpect message(%d) before handshake", context.Name(), message.Code)
+		context.Close()
+		return nil, ErrHandshake
+	}
+
+	whoAmI, err := gorpc.ReadWhoAmI(bytes.NewBuffer(message.Content))
+
+	if err != nil {
+		handler.E("[%s] unmarshal WhoAmI error\n%s", context.Name(), err)
+		context.Close()
+		return nil, err
+	}
+
+	var cert *x509.Certificate
+
+	if len(handler.state.PeerCertificates) > 0 {
+		cert = handler.state.PeerCertificates[0]
+	}
+
+	device, err := handler.identifier.Identify(cert, whoAmI)
+
+	if err != nil {
+		handler.E("[%s] identify device error\n%s", context.Name(), err)
+		context.Close()
+		return nil, err
+	}
+
+	handler.device = device
+
+	accept := gorpc.NewMessage()
+
+	accept.Code = gorpc.CodeAccept
+
+	context.Send(accept)
+
+	handler.I("[%s] tls device(%s) handshake -- success", context.Name(), device)
+
+	context.FireActive()
+
+	return nil, nil
+}
+
+func (handler *_TLSServer) MessageSending(context gorpc.Context, message *gorpc.Message) (*gorpc.Message, error) {
+	return message, nil
+}
+
+func (handler *_TLSServer) Panic(context gorpc.Context, err error) {
+}
@@ -0,0 +1,303 @@
+package gsproxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gsrpc/gorpc"
+)
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gsproxy-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := filepath.Join(dir, "cert.pem")
+
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return cert, keyFile
+}
+
+func TestLoadServerTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "gsproxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if config, err := loadServerTLS("", "", ""); config != nil || err != nil {
+		t.Fatal("expect tls disabled")
+	}
+
+	cert, key := writeTestCert(t, dir)
+
+	config, err := loadServerTLS(cert, key, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Certificates) != 1 || config.ClientAuth != tls.NoClientCert {
+		t.Fatal("expect server tls without client auth")
+	}
+
+	config, err = loadServerTLS(cert, key, cert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Fatal("expect mutual tls")
+	}
+
+	if _, err := loadServerTLS(cert, key, key); err == nil {
+		t.Fatal("expect invalid client ca error")
+	}
+}
+
+type _MockHandshakeContext struct {
+	_MockNamedContext
+	sent   []*gorpc.Message
+	active bool
+}
+
+func (mock *_MockHandshakeContext) Send(message *gorpc.Message) {
+	mock.sent = append(mock.sent, message)
+}
+
+func (mock *_MockHandshakeContext) FireActive() {
+	mock.active = true
+}
+
+func newWhoAmIRequest(id string, token string) *gorpc.Message {
+
+	whoAmI := gorpc.NewWhoAmI()
+
+	whoAmI.ID = gorpc.NewDevice()
+
+	whoAmI.ID.ID = id
+
+	whoAmI.Context = []byte(token)
+
+	var buff bytes.Buffer
+
+	gorpc.WriteWhoAmI(&buff, whoAmI)
+
+	message := gorpc.NewMessage()
+
+	message.Code = gorpc.CodeWhoAmI
+
+	message.Content = buff.Bytes()
+
+	return message
+}
+
+func TestTLSServerCert(t *testing.T) {
+
+	proxy := BuildProxy(&_MockProxy{}).newProxy("test")
+
+	proxy.tlsStates["mock"] = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "device"}}},
+	}
+
+	handler := proxy.newTLSServer(CertIdentifier()).(*_TLSServer)
+
+	context := &_MockHandshakeContext{}
+
+	context.pipeline = &_MockPipeline{}
+
+	if err := handler.Register(context); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handler.MessageReceived(context, newWhoAmIRequest("spoofed", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	if handler.GetDevice().ID != "device" || !context.active || len(context.sent) != 1 || context.sent[0].Code != gorpc.CodeAccept {
+		t.Fatal("expect device identified by certificate")
+	}
+
+	if message, _ := handler.MessageReceived(context, newPendingMessage()); message == nil {
+		t.Fatal("expect messages passed after handshake")
+	}
+}
+
+func TestTLSServerToken(t *testing.T) {
+
+	proxy := BuildProxy(&_MockProxy{}).newProxy("test")
+
+	proxy.tlsStates["mock"] = &tls.ConnectionState{}
+
+	identifier := TokenIdentifier(func(device *gorpc.Device, token []byte) error {
+		if string(token) != device.ID+"-token" {
+			return ErrDeviceIdentity
+		}
+
+		return nil
+	})
+
+	handler := proxy.newTLSServer(identifier).(*_TLSServer)
+
+	context := &_MockHandshakeContext{}
+
+	context.pipeline = &_MockPipeline{}
+
+	if err := handler.Register(context); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.Register(context); err != ErrTLSState {
+		t.Fatal("expect tls state consumed")
+	}
+
+	if _, err := handler.MessageReceived(context, newWhoAmIRequest("device", "invalid")); err != ErrDeviceIdentity || !context.closed {
+		t.Fatal("expect invalid token rejected")
+	}
+
+	if _, err := handler.MessageReceived(context, newWhoAmIRequest("device", "device-token")); err != nil {
+		t.Fatal(err)
+	}
+
+	if handler.GetDevice().ID != "device" {
+		t.Fatal("expect device identified by token")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "gsproxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+
+	config, err := loadServerTLS(cert, key, cert)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := BuildProxy(&_MockProxy{}).newProxy("test")
+
+	serverConn, clientConn := net.Pipe()
+
+	client := tls.Client(clientConn, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{certificate},
+	})
+
+	go client.Handshake()
+
+	server := tls.Server(serverConn, config)
+
+	var accepted bool
+
+	proxy.serve(func(name string, conn net.Conn) error {
+
+		accepted = true
+
+		state, ok := proxy.tlsState(name)
+
+		if !ok || len(state.PeerCertificates) != 1 || state.PeerCertificates[0].Subject.CommonName != "gsproxy-test" {
+			t.Fatal("expect tls state with client certificate")
+		}
+
+		return nil
+	}, server, server)
+
+	if !accepted {
+		t.Fatal("expect connection accepted after tls handshake")
+	}
+
+	client.Close()
+}
+
+func TestServeAcceptError(t *testing.T) {
+
+	proxy := BuildProxy(&_MockProxy{}).newProxy("test")
+
+	conn := newMockConn("127.0.0.1")
+
+	proxy.serve(func(name string, conn net.Conn) error {
+		return ErrTunnelID
+	}, conn, nil)
+
+	if !conn.closed {
+		t.Fatal("expect connection closed if accept failed")
+	}
+}
+
+func TestTLSCertIdentifierClientCA(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "gsproxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+
+	if _, err := BuildProxy(&_MockProxy{}).TLSF(cert, key, "").BuildE("test"); err != ErrTLSClientCA {
+		t.Fatal("expect certificate identifier without client ca rejected")
+	}
+}
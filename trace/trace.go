@@ -0,0 +1,223 @@
+// Package trace minimal W3C trace context propagation and span recording
+// across the gsproxy tunnel
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessageFlag gorpc message agent value marks the content is prefixed with traceparent
+const MessageFlag byte = 0xff
+
+// Errors .
+var (
+	ErrTraceparent = errors.New("invalid traceparent")
+)
+
+// SpanContext W3C trace context
+type SpanContext struct {
+	TraceID [16]byte // trace id
+	SpanID  [8]byte  // parent span id
+	Flags   byte     // trace flags
+}
+
+// IsValid check if trace and span id are not all zero
+func (context SpanContext) IsValid() bool {
+	return context.TraceID != [16]byte{} && context.SpanID != [8]byte{}
+}
+
+// String format as traceparent header value
+func (context SpanContext) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(context.TraceID[:]), hex.EncodeToString(context.SpanID[:]), context.Flags)
+}
+
+// Parse parse traceparent header value
+func Parse(traceparent string) (SpanContext, error) {
+
+	var context SpanContext
+
+	parts := strings.Split(traceparent, "-")
+
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return context, ErrTraceparent
+	}
+
+	if _, err := hex.Decode(context.TraceID[:], []byte(parts[1])); err != nil {
+		return context, ErrTraceparent
+	}
+
+	if _, err := hex.Decode(context.SpanID[:], []byte(parts[2])); err != nil {
+		return context, ErrTraceparent
+	}
+
+	var flags [1]byte
+
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return context, ErrTraceparent
+	}
+
+	context.Flags = flags[0]
+
+	if !context.IsValid() {
+		return context, ErrTraceparent
+	}
+
+	return context, nil
+}
+
+// Encode prefix message content with traceparent
+func Encode(context SpanContext, content []byte) []byte {
+
+	traceparent := context.String()
+
+	buff := make([]byte, 0, 1+len(traceparent)+len(content))
+
+	buff = append(buff, byte(len(traceparent)))
+
+	buff = append(buff, traceparent...)
+
+	return append(buff, content...)
+}
+
+// Decode split traceparent prefixed message content
+func Decode(content []byte) (SpanContext, []byte, error) {
+
+	if len(content) == 0 || len(content) < 1+int(content[0]) {
+		return SpanContext{}, nil, ErrTraceparent
+	}
+
+	length := 1 + int(content[0])
+
+	context, err := Parse(string(content[1:length]))
+
+	return context, content[length:], err
+}
+
+// Exporter receive finished spans
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Span one hop of a traced request, nil span ignores all updates
+type Span struct {
+	sync.Mutex                   // mutex
+	Name       string            // span name
+	Context    SpanContext       // span context, propagated to the next hop
+	Parent     SpanContext       // parent span context, invalid for root span
+	Start      time.Time         // start time
+	End        time.Time         // end time
+	Attributes map[string]string // attributes
+	Error      string            // error message, empty if succeed
+	exporter   Exporter          // exporter
+	finished   bool              // finished flag
+}
+
+// Start start span as child of parent, or a new trace if parent is invalid,
+// returns nil if exporter is nil
+func Start(exporter Exporter, name string, parent SpanContext) *Span {
+
+	if exporter == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Parent:     parent,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		exporter:   exporter,
+	}
+
+	span.Context.Flags = parent.Flags
+
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+	} else {
+		span.Context.Flags = 1
+		rand.Read(span.Context.TraceID[:])
+	}
+
+	rand.Read(span.Context.SpanID[:])
+
+	return span
+}
+
+// SpanContext get span context, zero if span is nil
+func (span *Span) SpanContext() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+
+	return span.Context
+}
+
+// Set set span attribute
+func (span *Span) Set(key string, val interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.Lock()
+	defer span.Unlock()
+
+	span.Attributes[key] = fmt.Sprintf("%v", val)
+}
+
+// Finish end span and export it, err marks the span failed
+func (span *Span) Finish(err error) {
+	if span == nil {
+		return
+	}
+
+	span.Lock()
+
+	if span.finished {
+		span.Unlock()
+		return
+	}
+
+	span.finished = true
+
+	span.End = time.Now()
+
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	span.Unlock()
+
+	span.exporter.Export(span)
+}
+
+// MemoryExporter exporter keeps spans in memory, for tests
+type MemoryExporter struct {
+	sync.Mutex         // mutex
+	spans      []*Span // exported spans
+}
+
+// NewMemoryExporter create memory exporter
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// Export implement Exporter
+func (exporter *MemoryExporter) Export(span *Span) {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	exporter.spans = append(exporter.spans, span)
+}
+
+// Spans get exported spans
+func (exporter *MemoryExporter) Spans() []*Span {
+	exporter.Lock()
+	defer exporter.Unlock()
+
+	return append([]*Span(nil), exporter.spans...)
+}
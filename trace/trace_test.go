@@ -0,0 +1,51 @@
+package trace
+
+import "testing"
+
+func TestTraceparent(t *testing.T) {
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	context, err := Parse(traceparent)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if context.String() != traceparent {
+		t.Fatalf("expect %s, got %s", traceparent, context)
+	}
+
+	if _, err := Parse("00-00000000000000000000000000000000-00f067aa0ba902b7-01"); err == nil {
+		t.Fatal("expect invalid zero trace id")
+	}
+}
+
+func TestEncode(t *testing.T) {
+
+	exporter := NewMemoryExporter()
+
+	span := Start(exporter, "test", SpanContext{})
+
+	context, content, err := Decode(Encode(span.SpanContext(), []byte("content")))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if context != span.SpanContext() || string(content) != "content" {
+		t.Fatal("expect decode the encoded trace context")
+	}
+
+	child := Start(exporter, "child", context)
+
+	child.Finish(nil)
+
+	child.Finish(nil)
+
+	spans := exporter.Spans()
+
+	if len(spans) != 1 || spans[0].Context.TraceID != span.Context.TraceID || spans[0].Parent != span.Context {
+		t.Fatal("expect one child span of the same trace")
+	}
+}
@@ -0,0 +1,50 @@
+package gsproxy
+
+import (
+	"testing"
+
+	"github.com/gsdocker/gsproxy/trace"
+)
+
+func TestTracing(t *testing.T) {
+
+	proxy, handler, servers := newPendingProxy()
+
+	exporter := trace.NewMemoryExporter()
+
+	proxy.tracer = exporter
+
+	parent, _ := trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	if err := handler.forwardRequest(servers[0], newRequestMessage(1, 1), newPendingRequest(1, 1), parent); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := servers[0].sent[0]
+
+	if sent.Agent != trace.MessageFlag {
+		t.Fatal("expect traced tunnel message")
+	}
+
+	propagated, _, err := trace.Decode(sent.Content)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if propagated.TraceID != parent.TraceID || propagated.SpanID == parent.SpanID {
+		t.Fatal("expect propagate the proxy span of client trace")
+	}
+
+	context := &_MockContext{pipeline: servers[0]}
+
+	if _, err := servers[0].tunnel.MessageReceived(context, newTunnelResponse(handler.device, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.Spans()
+
+	if len(spans) != 1 || spans[0].Parent != parent || spans[0].Context != propagated {
+		t.Fatal("expect proxy span exported")
+	}
+}